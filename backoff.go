@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// retryPolicy configures the delays between retries of failed operations.
+type retryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Jitter       float64       // randomization factor between 0 and 1
+	MaxElapsed   time.Duration // 0 means retry forever
+}
+
+// backoff computes exponentially increasing delays according to a
+// retryPolicy.
+type backoff struct {
+	policy  retryPolicy
+	attempt int
+	start   time.Time
+}
+
+func newBackoff(policy retryPolicy) *backoff {
+	return &backoff{policy: policy}
+}
+
+// Next returns the delay before the next retry. It returns false when
+// the maximum elapsed time since the first failure has been exceeded.
+func (b *backoff) Next() (time.Duration, bool) {
+	if b.attempt == 0 {
+		b.start = time.Now()
+	}
+
+	delay := b.policy.InitialDelay
+	for i := 0; i < b.attempt && delay < b.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > b.policy.MaxDelay {
+		delay = b.policy.MaxDelay
+	}
+	b.attempt++
+
+	if b.policy.Jitter > 0 {
+		delta := b.policy.Jitter * float64(delay)
+		delay = time.Duration(float64(delay) - delta + rand.Float64()*2*delta)
+	}
+
+	if b.policy.MaxElapsed > 0 && time.Since(b.start)+delay > b.policy.MaxElapsed {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+// Reset starts over with the initial delay.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// retry calls fn until it succeeds or the policy gives up, in which case
+// the last error is returned.
+func retry(policy retryPolicy, fn func() error) error {
+	b := newBackoff(policy)
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		delay, ok := b.Next()
+		if !ok {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
@@ -5,34 +5,118 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	log "github.com/Sirupsen/logrus"
 )
 
 type Config struct {
-	Interval        int        `toml:"interval"`
-	MetadataVersion string     `toml:"metadata-version"`
-	LogLevel        string     `toml:"log-level"`
-	OneTime         bool       `toml:"onetime"`
-	IncludeInactive bool       `toml:"include-inactive"`
-	Templates       []Template `toml:"template"`
+	Interval               int               `toml:"interval"`
+	MetadataURL            string            `toml:"metadata-url"`
+	MetadataVersion        string            `toml:"metadata-version"`
+	MetadataFile           string            `toml:"metadata-file"`
+	MetadataFallbackURLs   []string          `toml:"metadata-fallback-urls"`
+	MetadataTimeout        duration          `toml:"metadata-timeout"`
+	MetadataConnectTimeout duration          `toml:"metadata-connect-timeout"`
+	MetadataHeaders        map[string]string `toml:"metadata-headers"`
+	LogLevel               string            `toml:"log-level"`
+	OneTime                bool              `toml:"onetime"`
+	IncludeInactive        bool              `toml:"include-inactive"`
+	Watch                  bool              `toml:"watch"`
+	WatchTimeout           int               `toml:"watch-timeout"`
+	RecordDir              string            `toml:"record-dir"`
+	RecordKeep             int               `toml:"record-keep"`
+	RecordMaxAge           duration          `toml:"record-max-age"`
+	RetryInitialDelay      duration          `toml:"retry-initial-delay"`
+	RetryMaxDelay          duration          `toml:"retry-max-delay"`
+	RetryJitter            float64           `toml:"retry-jitter"`
+	RetryMaxElapsed        duration          `toml:"retry-max-elapsed"`
+	DegradedAfter          int               `toml:"degraded-after"`
+	Concurrency            int               `toml:"concurrency"`
+	Wait                   waitWindow        `toml:"wait"`
+	RepairDrift            bool              `toml:"repair-drift"`
+	Listen                 string            `toml:"listen"`
+	Exec                   string            `toml:"exec"`
+	ExecReloadSignal       string            `toml:"exec-reload-signal"`
+	ExecKillTimeout        duration          `toml:"exec-kill-timeout"`
+	Templates              []Template        `toml:"template"`
 }
 
 type Template struct {
-	Source       string `toml:"source"`
-	Dest         string `toml:"dest"`
-	CheckCmd     string `toml:"check-cmd"`
-	NotifyCmd    string `toml:"notify-cmd"`
-	NotifyOutput bool   `toml:"notify-output"`
+	Source                string            `toml:"source"`
+	Dest                  string            `toml:"dest"`
+	CheckCmd              string            `toml:"check-cmd"`
+	NotifyCmd             string            `toml:"notify-cmd"`
+	NotifyOutput          bool              `toml:"notify-output"`
+	NotifySignal          string            `toml:"notify-signal"`
+	NotifyPidfile         string            `toml:"notify-pidfile"`
+	NotifyProcess         string            `toml:"notify-process"`
+	NotifyURL             string            `toml:"notify-url"`
+	NotifyMethod          string            `toml:"notify-method"`
+	NotifyHeaders         map[string]string `toml:"notify-headers"`
+	NotifyBody            string            `toml:"notify-body"`
+	NotifyTimeout         duration          `toml:"notify-timeout"`
+	NotifyRetries         *int              `toml:"notify-retries"`
+	NotifyDocker          string            `toml:"notify-docker"`
+	NotifyDockerContainer string            `toml:"notify-docker-container"`
+	NotifyDockerLabel     string            `toml:"notify-docker-label"`
+	NotifyDockerPrimary   bool              `toml:"notify-docker-primary"`
+	NotifyDockerSignal    string            `toml:"notify-docker-signal"`
+	NotifyDockerCmd       []string          `toml:"notify-docker-cmd"`
+	NotifyDockerSocket    string            `toml:"notify-docker-socket"`
+	IncludeInactive       bool              `toml:"include-inactive"`
+	Partials              []string          `toml:"partials"`
+	Wait                  *waitWindow       `toml:"wait"`
+}
+
+// duration is a time.Duration that can be decoded from a TOML string
+// such as "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
 }
 
 func initConfig() (*Config, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	lvl, _ := log.ParseLevel(config.LogLevel)
+	log.SetLevel(lvl)
+
+	return config, nil
+}
+
+// loadConfig reads and validates the configuration from the config file,
+// the environment and the command line.
+func loadConfig() (*Config, error) {
 	config := Config{
-		MetadataVersion: "latest",
-		Interval:        5,
-		LogLevel:        "info",
+		MetadataURL:            "http://rancher-metadata",
+		MetadataVersion:        "latest",
+		MetadataTimeout:        duration(10 * time.Second),
+		MetadataConnectTimeout: duration(3 * time.Second),
+		Interval:               5,
+		WatchTimeout:           30,
+		RecordKeep:             100,
+		RetryInitialDelay:      duration(time.Second),
+		RetryMaxDelay:          duration(time.Minute),
+		RetryJitter:            0.2,
+		RetryMaxElapsed:        duration(time.Minute),
+		DegradedAfter:          5,
+		Concurrency:            1,
+		ExecKillTimeout:        duration(10 * time.Second),
+		LogLevel:               "info",
 	}
 
 	if len(configFile) > 0 {
@@ -52,16 +136,102 @@ func initConfig() (*Config, error) {
 		return nil, fmt.Errorf("Interval must be greater than 0")
 	}
 
-	lvl, err := log.ParseLevel(config.LogLevel)
-	if err != nil {
-		return nil, fmt.Errorf("Invalid log level: %s", config.LogLevel)
+	if config.MetadataTimeout <= 0 || config.MetadataConnectTimeout <= 0 {
+		return nil, fmt.Errorf("Metadata timeouts must be greater than 0")
 	}
 
-	log.SetLevel(lvl)
+	if config.RetryInitialDelay <= 0 || config.RetryMaxDelay < config.RetryInitialDelay {
+		return nil, fmt.Errorf("Retry delays must be greater than 0 and the maximum delay must not be lower than the initial delay")
+	}
+
+	if config.RetryJitter < 0 || config.RetryJitter > 1 {
+		return nil, fmt.Errorf("Retry jitter must be between 0 and 1")
+	}
+
+	if config.Concurrency <= 0 {
+		return nil, fmt.Errorf("Concurrency must be greater than 0")
+	}
+
+	if err := validateTemplates(config.Templates); err != nil {
+		return nil, err
+	}
+
+	if config.ExecReloadSignal != "" {
+		if _, err := parseSignal(config.ExecReloadSignal); err != nil {
+			return nil, fmt.Errorf("Invalid exec reload signal: %v", err)
+		}
+	}
+
+	if config.Watch && config.WatchTimeout <= 0 {
+		return nil, fmt.Errorf("Watch timeout must be greater than 0")
+	}
+
+	if _, err := log.ParseLevel(config.LogLevel); err != nil {
+		return nil, fmt.Errorf("Invalid log level: %s", config.LogLevel)
+	}
 
 	return &config, nil
 }
 
+// validateTemplates checks the notification options of the templates and
+// that no two templates share a destination, since they would overwrite
+// each other.
+func validateTemplates(templates []Template) error {
+	sources := make(map[string]string)
+	for _, t := range templates {
+		if err := validateNotifications(t); err != nil {
+			return fmt.Errorf("Template %s: %v", t.Source, err)
+		}
+		if t.Dest == "" {
+			continue
+		}
+		dest := filepath.Clean(t.Dest)
+		if source, ok := sources[dest]; ok {
+			return fmt.Errorf("Templates %s and %s share the destination %s", source, t.Source, t.Dest)
+		}
+		sources[dest] = t.Source
+	}
+	return nil
+}
+
+// validateNotifications checks the signal, URL and Docker notification
+// options of the template.
+func validateNotifications(t Template) error {
+	if err := validateNotifySignal(t); err != nil {
+		return err
+	}
+	if err := validateNotifyURL(t); err != nil {
+		return err
+	}
+	return validateNotifyDocker(t)
+}
+
+func validateNotifySignal(t Template) error {
+	if t.NotifySignal == "" {
+		if t.NotifyPidfile != "" || t.NotifyProcess != "" {
+			return fmt.Errorf("notify-signal is required with notify-pidfile and notify-process")
+		}
+		return nil
+	}
+	if _, err := parseSignal(t.NotifySignal); err != nil {
+		return err
+	}
+	if (t.NotifyPidfile == "") == (t.NotifyProcess == "") {
+		return fmt.Errorf("notify-signal requires either notify-pidfile or notify-process")
+	}
+	return nil
+}
+
+// retryPolicy returns the policy for retrying failed Metadata requests.
+func (c *Config) retryPolicy() retryPolicy {
+	return retryPolicy{
+		InitialDelay: time.Duration(c.RetryInitialDelay),
+		MaxDelay:     time.Duration(c.RetryMaxDelay),
+		Jitter:       c.RetryJitter,
+		MaxElapsed:   time.Duration(c.RetryMaxElapsed),
+	}
+}
+
 func setConfigFromFile(path string, conf *Config) error {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -94,10 +264,61 @@ func overwriteConfigFromFlags(conf *Config) {
 			conf.Interval = interval
 		case "metadata-version":
 			conf.MetadataVersion = metadataVersion
+		case "metadata-url":
+			conf.MetadataURL = metadataURL
+		case "metadata-fallback-urls":
+			conf.MetadataFallbackURLs = splitList(metadataFallbackURLs)
+		case "metadata-timeout":
+			conf.MetadataTimeout = duration(metadataTimeout)
+		case "metadata-connect-timeout":
+			conf.MetadataConnectTimeout = duration(metadataConnectTimeout)
+		case "metadata-header":
+			if conf.MetadataHeaders == nil {
+				conf.MetadataHeaders = make(map[string]string)
+			}
+			for name, value := range metadataHeaders {
+				conf.MetadataHeaders[name] = value
+			}
+		case "metadata-file":
+			conf.MetadataFile = metadataFile
 		case "onetime":
 			conf.OneTime = onetime
 		case "include-inactive":
 			conf.IncludeInactive = includeInactive
+		case "watch":
+			conf.Watch = watch
+		case "watch-timeout":
+			conf.WatchTimeout = watchTimeout
+		case "retry-initial-delay":
+			conf.RetryInitialDelay = duration(retryInitialDelay)
+		case "retry-max-delay":
+			conf.RetryMaxDelay = duration(retryMaxDelay)
+		case "retry-jitter":
+			conf.RetryJitter = retryJitter
+		case "retry-max-elapsed":
+			conf.RetryMaxElapsed = duration(retryMaxElapsed)
+		case "degraded-after":
+			conf.DegradedAfter = degradedAfter
+		case "concurrency":
+			conf.Concurrency = concurrency
+		case "wait":
+			conf.Wait = wait
+		case "repair-drift":
+			conf.RepairDrift = repairDrift
+		case "listen":
+			conf.Listen = listen
+		case "exec":
+			conf.Exec = execCmd
+		case "exec-reload-signal":
+			conf.ExecReloadSignal = execReloadSignal
+		case "exec-kill-timeout":
+			conf.ExecKillTimeout = duration(execKillTimeout)
+		case "record-dir":
+			conf.RecordDir = recordDir
+		case "record-keep":
+			conf.RecordKeep = recordKeep
+		case "record-max-age":
+			conf.RecordMaxAge = duration(recordMaxAge)
 		case "log-level":
 			conf.LogLevel = logLevel
 		}
@@ -120,10 +341,43 @@ func overwriteConfigFromEnv(conf *Config) {
 	if env = os.Getenv("RANCHER_GEN_METADATA_VER"); len(env) > 0 {
 		conf.MetadataVersion = env
 	}
+	if env = os.Getenv("RANCHER_GEN_METADATA_URL"); len(env) > 0 {
+		conf.MetadataURL = env
+	}
+	if env = os.Getenv("RANCHER_GEN_METADATA_FALLBACK_URLS"); len(env) > 0 {
+		conf.MetadataFallbackURLs = splitList(env)
+	}
+	if env = os.Getenv("RANCHER_GEN_METADATA_TIMEOUT"); len(env) > 0 {
+		if timeout, err := time.ParseDuration(env); err == nil {
+			conf.MetadataTimeout = duration(timeout)
+		} else {
+			log.Warnf("Invalid value for environment variable 'RANCHER_GEN_METADATA_TIMEOUT': %s", env)
+		}
+	}
+	if env = os.Getenv("RANCHER_GEN_METADATA_FILE"); len(env) > 0 {
+		conf.MetadataFile = env
+	}
+	if env = os.Getenv("RANCHER_GEN_RECORD_DIR"); len(env) > 0 {
+		conf.RecordDir = env
+	}
 	if env = os.Getenv("RANCHER_GEN_ONETIME"); len(env) > 0 {
 		conf.OneTime = true
 	}
 	if env = os.Getenv("RANCHER_GEN_INACTIVE"); len(env) > 0 {
 		conf.IncludeInactive = true
 	}
+	if env = os.Getenv("RANCHER_GEN_WATCH"); len(env) > 0 {
+		conf.Watch = true
+	}
+}
+
+// splitList splits a comma separated list, omitting empty items.
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates []Template
+		err       bool
+	}{
+		{"distinct destinations", []Template{{Source: "a.tmpl", Dest: "/etc/a.conf"}, {Source: "b.tmpl", Dest: "/etc/b.conf"}}, false},
+		{"printed to stdout", []Template{{Source: "a.tmpl"}, {Source: "b.tmpl"}}, false},
+		{"shared destination", []Template{{Source: "a.tmpl", Dest: "/etc/app.conf"}, {Source: "b.tmpl", Dest: "/etc/app.conf"}}, true},
+		{"same destination path", []Template{{Source: "a.tmpl", Dest: "/etc/app.conf"}, {Source: "b.tmpl", Dest: "/etc/./app.conf"}}, true},
+		{"invalid notification", []Template{{Source: "a.tmpl", Dest: "/etc/app.conf", NotifyDocker: "stop"}}, true},
+	}
+
+	for _, test := range tests {
+		if err := validateTemplates(test.templates); (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error: %t", test.name, err, test.err)
+		}
+	}
+}
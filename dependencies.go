@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// lookupFuncs are the template functions that query the Metadata. Their
+// calls are recorded as dependencies of a template.
+var lookupFuncs = map[string]func(*TemplateContext) func(...string) (interface{}, error){
+	"host":     hostFunc,
+	"hosts":    hostsFunc,
+	"service":  serviceFunc,
+	"services": servicesFunc,
+	"links":    linksFunc,
+	"stack":    stackFunc,
+	"stacks":   stacksFunc,
+}
+
+// lookup is a call of a lookup function and a checksum of its result.
+type lookup struct {
+	Func string
+	Args []string
+	Hash string
+}
+
+// dependencies records the Metadata a template used when it was rendered,
+// so that it only needs to be rendered again if that Metadata changes.
+type dependencies struct {
+	lookups []lookup
+	// untracked is set if the template accessed Metadata that is not
+	// covered by the lookups, e.g. the root data.
+	untracked bool
+}
+
+// track wraps the lookup function so that its calls are recorded.
+func (d *dependencies) track(name string, fn func(...string) (interface{}, error)) func(...string) (interface{}, error) {
+	return func(args ...string) (interface{}, error) {
+		result, err := fn(args...)
+		hash, ok := hashLookup(result, err)
+		if !ok {
+			d.untracked = true
+		}
+		d.lookups = append(d.lookups, lookup{name, args, hash})
+		return result, err
+	}
+}
+
+// Changed returns true if any of the lookups returns a different result
+// for the given context.
+func (d *dependencies) Changed(ctx *TemplateContext) bool {
+	if d == nil || d.untracked {
+		return true
+	}
+
+	for _, l := range d.lookups {
+		hash, ok := hashLookup(lookupFuncs[l.Func](ctx)(l.Args...))
+		if !ok || hash != l.Hash {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashLookup(result interface{}, err error) (string, bool) {
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%x", md5.Sum(buf)), true
+}
+
+// usesRootData returns true if the template or one of its associated
+// templates accesses the root data, e.g. {{.Services}} outside of range
+// and with blocks or {{$.Services}}. Associated templates are assumed to
+// be invoked with the root data.
+func usesRootData(tmpl *template.Template) bool {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && nodeUsesRootData(t.Tree.Root, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeUsesRootData walks the parse tree. rootDot is true while dot refers
+// to the root data.
+func nodeUsesRootData(node parse.Node, rootDot bool) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if nodeUsesRootData(child, rootDot) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesRootData(n.Pipe, rootDot)
+	case *parse.IfNode:
+		return nodeUsesRootData(n.Pipe, rootDot) || nodeUsesRootData(n.List, rootDot) ||
+			nodeUsesRootData(n.ElseList, rootDot)
+	case *parse.RangeNode:
+		return nodeUsesRootData(n.Pipe, rootDot) || nodeUsesRootData(n.List, false) ||
+			nodeUsesRootData(n.ElseList, rootDot)
+	case *parse.WithNode:
+		return nodeUsesRootData(n.Pipe, rootDot) || nodeUsesRootData(n.List, false) ||
+			nodeUsesRootData(n.ElseList, rootDot)
+	case *parse.TemplateNode:
+		// passing dot on is covered by checking the invoked template
+		if n.Pipe != nil && len(n.Pipe.Cmds) == 1 && len(n.Pipe.Cmds[0].Args) == 1 {
+			if _, ok := n.Pipe.Cmds[0].Args[0].(*parse.DotNode); ok {
+				return false
+			}
+		}
+		return nodeUsesRootData(n.Pipe, rootDot)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesRootData(cmd, rootDot) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesRootData(arg, rootDot) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeUsesRootData(n.Node, rootDot)
+	case *parse.FieldNode, *parse.DotNode:
+		return rootDot
+	case *parse.VariableNode:
+		return n.Ident[0] == "$"
+	}
+
+	return false
+}
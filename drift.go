@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// restoreDrifted restores destinations that differ from the content they
+// were last written with, e.g. because they have been edited or deleted
+// by another process. It returns true if any destination was restored.
+func restoreDrifted(states []*templateState, ctx *TemplateContext) bool {
+	restored := false
+	for _, state := range states {
+		t := state.Template
+		if t.Dest == "" || state.content == nil {
+			continue
+		}
+
+		current, err := ioutil.ReadFile(t.Dest)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Could not check destination %s for drift: %v", t.Dest, err)
+			continue
+		}
+		if err == nil && bytes.Equal(current, state.content) {
+			continue
+		}
+
+		logger := log.WithField("template", t.Source)
+		if err != nil {
+			logger.Warnf("Destination %s has been deleted", t.Dest)
+		} else {
+			logger.Warnf("Destination %s has drifted: %s", t.Dest, diffSummary(state.content, current))
+		}
+
+		if err := writeDestination(logger, t, state.content); err != nil {
+			logger.Errorf("Failed to repair destination %s: %v", t.Dest, err)
+			continue
+		}
+		restored = true
+		if err := notifyDestination(logger, t, state.content, state.contentVersion, ctx); err != nil {
+			logger.Errorf("Failed to notify about repaired destination %s: %v", t.Dest, err)
+		}
+	}
+	return restored
+}
+
+// diffSummary describes the lines in which actual differs from expected.
+func diffSummary(expected, actual []byte) string {
+	exp := strings.Split(string(expected), "\n")
+	act := strings.Split(string(actual), "\n")
+
+	prefix := 0
+	for prefix < len(exp) && prefix < len(act) && exp[prefix] == act[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(exp)-prefix && suffix < len(act)-prefix &&
+		exp[len(exp)-1-suffix] == act[len(act)-1-suffix] {
+		suffix++
+	}
+
+	removed := len(exp) - prefix - suffix
+	added := len(act) - prefix - suffix
+	return fmt.Sprintf("%d line(s) replaced by %d line(s) starting at line %d", removed, added, prefix+1)
+}
+
+// newDestinationWatcher watches the destinations of the templates.
+func newDestinationWatcher(templates []Template) (*fileWatcher, error) {
+	dirs := newDirSet()
+	for _, t := range templates {
+		if t.Dest != "" {
+			dirs.add(filepath.Dir(filepath.Clean(t.Dest)))
+		}
+	}
+
+	return newFileWatcher(dirs.list, func(path string) []int {
+		var indexes []int
+		for i, t := range templates {
+			if t.Dest != "" && filepath.Clean(t.Dest) == path {
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes
+	})
+}
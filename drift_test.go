@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreDrifted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "app.conf")
+
+	state := newTemplateStates(&Config{Templates: []Template{{Source: "app.tmpl", Dest: dest}}})[0]
+	expect := func(content string, restored, want bool) {
+		t.Helper()
+		if restored != want {
+			t.Errorf("restored: %t, want %t", restored, want)
+		}
+		if buf, err := ioutil.ReadFile(dest); err != nil || string(buf) != content {
+			t.Errorf("destination contains %q, %v, want %q", buf, err, content)
+		}
+	}
+
+	ioutil.WriteFile(dest, []byte("v1"), 0644)
+	state.Done("1", &render{content: []byte("v1"), updated: true}, nil)
+	expect("v1", restoreDrifted([]*templateState{state}, nil), false)
+
+	// v2 is written, but its notification fails
+	ioutil.WriteFile(dest, []byte("v2"), 0644)
+	state.Done("2", &render{content: []byte("v2"), updated: true}, errors.New("notify failed"))
+	expect("v2", restoreDrifted([]*templateState{state}, nil), false)
+
+	// v3 fails its check command and is not written
+	state.Done("3", &render{content: []byte("v3")}, errors.New("check failed"))
+	expect("v2", restoreDrifted([]*templateState{state}, nil), false)
+
+	ioutil.WriteFile(dest, []byte("edited"), 0644)
+	expect("v2", restoreDrifted([]*templateState{state}, nil), true)
+
+	os.Remove(dest)
+	expect("v2", restoreDrifted([]*templateState{state}, nil), true)
+}
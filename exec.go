@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// signals maps the names of signals that can be sent to processes.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// parseSignal returns the signal with the given name, e.g. "SIGHUP" or
+// "HUP".
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown signal '%s'", name)
+	}
+	return sig, nil
+}
+
+// execShell runs the command in exec mode.
+var execShell = "/bin/sh"
+
+// exitError is returned by Run when rancher-gen should exit with the
+// given status, e.g. the exit status of the child process in exec mode.
+type exitError struct {
+	code int
+}
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// process is a started child process.
+type process struct {
+	cmd    *exec.Cmd
+	done   chan struct{}      // closed when the process has exited
+	status syscall.WaitStatus // exit status of the process
+	err    error              // waiting for the process failed
+}
+
+// child supervises the command run in exec mode. After templates have
+// been updated, it sends the reload signal to the command or, without a
+// reload signal, restarts it.
+type child struct {
+	command      string
+	reloadSignal syscall.Signal
+	killTimeout  time.Duration
+	proc         *process
+	restartErr   error   // why the command could not be restarted
+	reaper       *reaper // reaps the command if orphans are reaped
+}
+
+func newChild(conf *Config) *child {
+	c := &child{
+		command:     conf.Exec,
+		killTimeout: time.Duration(conf.ExecKillTimeout),
+	}
+	if conf.ExecReloadSignal != "" {
+		c.reloadSignal, _ = parseSignal(conf.ExecReloadSignal)
+	}
+	return c
+}
+
+// Start runs the command. The command is run by the shell, which is
+// replaced by the command so that signals are delivered to it directly.
+// If orphans are reaped, the exit status of the command is received from
+// the reaper instead of waiting for it.
+func (c *child) Start() error {
+	cmd := exec.Command(execShell, "-c", "exec "+c.command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	reapLock.RLock()
+	if err := cmd.Start(); err != nil {
+		reapLock.RUnlock()
+		return fmt.Errorf("Could not start '%s': %v", c.command, err)
+	}
+	log.Infof("Started '%s' with pid %d", c.command, cmd.Process.Pid)
+
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	if c.reaper != nil {
+		exited := c.reaper.Watch(cmd.Process.Pid)
+		reapLock.RUnlock()
+		go func() {
+			p.status = <-exited
+			cmd.Process.Release()
+			close(p.done)
+		}()
+	} else {
+		reapLock.RUnlock()
+		go func() {
+			err := cmd.Wait()
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				p.status, _ = exitErr.Sys().(syscall.WaitStatus)
+			} else {
+				p.err = err
+			}
+			close(p.done)
+		}()
+	}
+	c.proc = p
+	return nil
+}
+
+// Started returns true if the command has been started.
+func (c *child) Started() bool {
+	return c.proc != nil
+}
+
+// Running returns true if the command has been started and has not exited.
+func (c *child) Running() bool {
+	if c == nil || c.proc == nil {
+		return false
+	}
+	select {
+	case <-c.proc.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Exited returns a channel that is closed when the command exits. The
+// channel never closes if the command has not been started.
+func (c *child) Exited() <-chan struct{} {
+	if c == nil || c.proc == nil {
+		return nil
+	}
+	return c.proc.done
+}
+
+// ExitCode returns the exit status of the exited command. If the command
+// was terminated by a signal, the status is 128 plus the signal number.
+func (c *child) ExitCode() int {
+	if c.proc.err != nil {
+		return 1
+	}
+	if c.proc.status.Signaled() {
+		return 128 + int(c.proc.status.Signal())
+	}
+	return c.proc.status.ExitStatus()
+}
+
+// Signal sends the signal to the command.
+func (c *child) Signal(sig os.Signal) error {
+	log.Debugf("Sending %v to '%s'", sig, c.command)
+	return c.proc.cmd.Process.Signal(sig)
+}
+
+// Reload makes the command pick up updated files.
+func (c *child) Reload() error {
+	if c.reloadSignal != 0 {
+		log.Infof("Sending %v to '%s'", c.reloadSignal, c.command)
+		return c.Signal(c.reloadSignal)
+	}
+
+	log.Infof("Restarting '%s'", c.command)
+	c.Stop()
+	if err := c.Start(); err != nil {
+		c.restartErr = err
+		return err
+	}
+	return nil
+}
+
+// RestartErr returns the error that prevented the command from being
+// restarted. The command has exited in that case.
+func (c *child) RestartErr() error {
+	return c.restartErr
+}
+
+// Stop terminates the command and waits for it to exit. If it does not
+// exit within the kill timeout, it is killed.
+func (c *child) Stop() {
+	if !c.Running() {
+		return
+	}
+
+	c.Signal(syscall.SIGTERM)
+	select {
+	case <-c.proc.done:
+	case <-time.After(c.killTimeout):
+		log.Warnf("'%s' did not exit within %v, killing it", c.command, c.killTimeout)
+		c.Signal(syscall.SIGKILL)
+		<-c.proc.done
+	}
+}
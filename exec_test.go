@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func waitExited(t *testing.T, c *child) {
+	t.Helper()
+	select {
+	case <-c.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not exit")
+	}
+}
+
+func TestChildExitCode(t *testing.T) {
+	tests := []struct {
+		command string
+		signal  syscall.Signal
+		want    int
+	}{
+		{command: "true", want: 0},
+		{command: "sh -c 'exit 3'", want: 3},
+		{command: "sleep 10", signal: syscall.SIGTERM, want: 128 + int(syscall.SIGTERM)},
+	}
+
+	for _, test := range tests {
+		c := newChild(&Config{Exec: test.command})
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if test.signal != 0 {
+			c.Signal(test.signal)
+		}
+		waitExited(t, c)
+		if code := c.ExitCode(); code != test.want {
+			t.Errorf("%s: got exit status %d, want %d", test.command, code, test.want)
+		}
+	}
+}
+
+func TestChildReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "log")
+
+	script := "trap 'echo reload >> " + logFile + "' HUP; echo start >> " + logFile + "; while :; do sleep 0.05; done"
+	c := newChild(&Config{Exec: "sh -c \"" + script + "\"", ExecReloadSignal: "HUP", ExecKillTimeout: duration(time.Second)})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// without a reload signal the command is restarted
+	c.reloadSignal = 0
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	c.Stop()
+
+	buf, _ := ioutil.ReadFile(logFile)
+	if got := strings.Fields(string(buf)); strings.Join(got, " ") != "start reload start" {
+		t.Errorf("got %v, want [start reload start]", got)
+	}
+}
+
+func TestChildStopKillsAfterTimeout(t *testing.T) {
+	c := newChild(&Config{Exec: "sh -c \"trap '' TERM; while :; do sleep 0.05; done\"", ExecKillTimeout: duration(200 * time.Millisecond)})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c.Stop()
+	if c.Running() {
+		t.Fatal("command is still running")
+	}
+	if code := c.ExitCode(); code != 128+int(syscall.SIGKILL) {
+		t.Errorf("got exit status %d, want %d", code, 128+int(syscall.SIGKILL))
+	}
+}
+
+func TestChildRestartFailure(t *testing.T) {
+	c := newChild(&Config{Exec: "sleep 10", ExecKillTimeout: duration(time.Second)})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(shell string) { execShell = shell }(execShell)
+	execShell = "/nonexistent/sh"
+	if err := c.Reload(); err == nil {
+		t.Fatal("restart succeeded")
+	}
+	waitExited(t, c)
+	if c.RestartErr() == nil {
+		t.Error("failed restart is not reported")
+	}
+
+	r := &runner{Config: &Config{Exec: "sleep 10"}, child: c}
+	if err := r.childExited(); err == nil || !strings.Contains(err.Error(), "Failed to restart") {
+		t.Errorf("got %v, want restart failure", err)
+	}
+}
+
+// processState returns the state of the process from /proc/<pid>/stat,
+// or an empty string if the process does not exist.
+func processState(pid string) string {
+	buf, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(buf[strings.LastIndex(string(buf), ")")+1:]))
+	return fields[0]
+}
+
+func TestChildReapsOrphans(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc is not available")
+	}
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "pid")
+
+	reaper, err := startReaper()
+	if err != nil {
+		t.Skipf("Cannot reap orphans: %v", err)
+	}
+	defer reaper.Stop()
+
+	// the command leaves behind a short-lived grandchild
+	c := newChild(&Config{Exec: "sh -c 'sleep 0.2 & echo $! > " + pidfile + "; exit 3'"})
+	c.reaper = reaper
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitExited(t, c)
+	if code := c.ExitCode(); code != 3 {
+		t.Errorf("got exit status %d, want 3", code)
+	}
+
+	buf, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strings.TrimSpace(string(buf))
+	deadline := time.Now().Add(5 * time.Second)
+	for processState(pid) != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("orphaned process %s was not reaped (state %s)", pid, processState(pid))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// commands run meanwhile still get their exit status
+	if err := check(log.WithField("template", "test"), "exit 0", ""); err != nil {
+		t.Errorf("check command failed while reaping: %v", err)
+	}
+}
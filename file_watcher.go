@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchDebounce is how long to wait for further changes after a file
+// changed, so that a file written in several steps is reported once.
+const watchDebounce = 200 * time.Millisecond
+
+// fileWatcher watches directories for changed files and reports the
+// indexes of the templates affected by them.
+type fileWatcher struct {
+	affected func(path string) []int
+	events   chan string
+	changes  chan []int
+	done     chan struct{}
+	closer   io.Closer
+}
+
+func newFileWatcher(dirs []string, affected func(path string) []int) (*fileWatcher, error) {
+	w := &fileWatcher{
+		affected: affected,
+		events:   make(chan string, 64),
+		changes:  make(chan []int),
+		done:     make(chan struct{}),
+	}
+
+	closer, err := watchDirs(dirs, w.event)
+	if err != nil {
+		return nil, err
+	}
+	w.closer = closer
+
+	go w.run()
+	return w, nil
+}
+
+// Changes returns a channel that receives the indexes of the templates
+// affected by changed files. The channel of a nil watcher never receives.
+func (w *fileWatcher) Changes() <-chan []int {
+	if w == nil {
+		return nil
+	}
+	return w.changes
+}
+
+// Close stops watching the directories.
+func (w *fileWatcher) Close() error {
+	close(w.done)
+	return w.closer.Close()
+}
+
+func (w *fileWatcher) event(path string) {
+	select {
+	case w.events <- path:
+	case <-w.done:
+	}
+}
+
+func (w *fileWatcher) run() {
+	changed := make(map[int]bool)
+	var flush <-chan time.Time
+	for {
+		select {
+		case path := <-w.events:
+			for _, i := range w.affected(path) {
+				changed[i] = true
+			}
+			if len(changed) > 0 && flush == nil {
+				flush = time.After(watchDebounce)
+			}
+		case <-flush:
+			indexes := make([]int, 0, len(changed))
+			for i := range changed {
+				indexes = append(indexes, i)
+			}
+			sort.Ints(indexes)
+			select {
+			case w.changes <- indexes:
+			case <-w.done:
+				return
+			}
+			changed = make(map[int]bool)
+			flush = nil
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// newSourceWatcher watches the source files and partials of the templates.
+func newSourceWatcher(templates []Template) (*fileWatcher, error) {
+	return newFileWatcher(sourceDirs(templates), func(path string) []int {
+		return sourcesAffected(templates, path)
+	})
+}
+
+// sourcesAffected returns the indexes of the templates that use the given
+// file as source or partial.
+func sourcesAffected(templates []Template, path string) []int {
+	var indexes []int
+	for i, t := range templates {
+		if filepath.Clean(t.Source) == path {
+			indexes = append(indexes, i)
+			continue
+		}
+		for _, pattern := range t.Partials {
+			if match, _ := filepath.Match(filepath.Clean(pattern), path); match {
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// sourceDirs returns the directories containing template sources and
+// partials. Directories are watched instead of files so that files
+// replaced by editors or created after startup are noticed.
+func sourceDirs(templates []Template) []string {
+	dirs := newDirSet()
+	for _, t := range templates {
+		dirs.add(filepath.Dir(filepath.Clean(t.Source)))
+		for _, pattern := range t.Partials {
+			dir := filepath.Dir(filepath.Clean(pattern))
+			if !strings.ContainsAny(dir, `*?[\`) {
+				dirs.add(dir)
+				continue
+			}
+			matches, _ := filepath.Glob(pattern)
+			for _, match := range matches {
+				dirs.add(filepath.Dir(match))
+			}
+		}
+	}
+	return dirs.list
+}
+
+// dirSet is an ordered set of directories.
+type dirSet struct {
+	seen map[string]bool
+	list []string
+}
+
+func newDirSet() *dirSet {
+	return &dirSet{seen: make(map[string]bool)}
+}
+
+func (d *dirSet) add(dir string) {
+	if !d.seen[dir] {
+		d.seen[dir] = true
+		d.list = append(d.list, dir)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the inotify events that indicate that a file in a
+// watched directory has been written, replaced or removed.
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_CREATE | unix.IN_DELETE
+
+// watchDirs watches the given directories with inotify and calls fn with
+// the path of every file that changes in them until the returned Closer
+// is closed.
+func watchDirs(dirs []string, fn func(path string)) (io.Closer, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize inotify: %v", err)
+	}
+
+	watches := make(map[int32]string)
+	for _, dir := range dirs {
+		wd, err := unix.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			log.Warnf("Cannot watch directory %s: %v", dir, err)
+			continue
+		}
+		log.Debugf("Watching directory %s", dir)
+		watches[int32(wd)] = dir
+	}
+
+	// The non-blocking descriptor is handled by the runtime poller, so
+	// closing the file interrupts a pending read.
+	file := os.NewFile(uintptr(fd), "inotify")
+	go readEvents(file, watches, fn)
+	return file, nil
+}
+
+func readEvents(file *os.File, watches map[int32]string, fn func(path string)) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+256))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Warnf("Stopped watching directories: %v", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + int(event.Len)
+
+			dir, ok := watches[event.Wd]
+			if !ok || event.Len == 0 {
+				continue
+			}
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			fn(filepath.Join(dir, name))
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// watchDirs is only implemented on Linux.
+func watchDirs(dirs []string, fn func(path string)) (io.Closer, error) {
+	return nil, fmt.Errorf("Watching files is not supported on %s", runtime.GOOS)
+}
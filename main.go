@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -13,16 +15,40 @@ var (
 	Version string = "UNDEFINED"
 	GitSHA  string = "UNDEFINED"
 
-	configFile      string
-	metadataVersion string
-	logLevel        string
-	checkCmd        string
-	notifyCmd       string
-	onetime         bool
-	showVersion     bool
-	notifyOutput    bool
-	includeInactive bool
-	interval        int
+	configFile             string
+	metadataURL            string
+	metadataVersion        string
+	metadataFallbackURLs   string
+	metadataFile           string
+	logLevel               string
+	checkCmd               string
+	notifyCmd              string
+	recordDir              string
+	onetime                bool
+	showVersion            bool
+	notifyOutput           bool
+	includeInactive        bool
+	watch                  bool
+	interval               int
+	watchTimeout           int
+	recordKeep             int
+	recordMaxAge           time.Duration
+	metadataTimeout        time.Duration
+	metadataConnectTimeout time.Duration
+	metadataHeaders        = headerFlags{}
+	retryInitialDelay      time.Duration
+	retryMaxDelay          time.Duration
+	retryMaxElapsed        time.Duration
+	retryJitter            float64
+	degradedAfter          int
+	concurrency            int
+	wait                   waitWindow
+	repairDrift            bool
+	listen                 string
+	execCmd                string
+	execReloadSignal       string
+	execKillTimeout        time.Duration
+	replayOut              string
 )
 
 func init() {
@@ -30,21 +56,45 @@ func init() {
 	log.SetOutput(os.Stdout)
 
 	flag.StringVar(&configFile, "config", "", "Path to optional config file")
+	flag.StringVar(&metadataURL, "metadata-url", "http://rancher-metadata", "URL of the Rancher Metadata API")
+	flag.StringVar(&metadataFallbackURLs, "metadata-fallback-urls", "", "Comma separated list of Metadata API URLs to fail over to")
+	flag.DurationVar(&metadataTimeout, "metadata-timeout", 10*time.Second, "Timeout for requests to the Metadata API")
+	flag.DurationVar(&metadataConnectTimeout, "metadata-connect-timeout", 3*time.Second, "Timeout for connecting to the Metadata API")
+	flag.Var(metadataHeaders, "metadata-header", "Additional header ('Name: value') sent with Metadata API requests. Can be repeated.")
 	flag.StringVar(&metadataVersion, "metadata-version", "latest", "Metadata version to use for querying the Metadata API")
+	flag.StringVar(&metadataFile, "metadata-file", "", "Path to a JSON dump of the Metadata API to use instead of the Rancher Metadata service")
 	flag.IntVar(&interval, "interval", 60, "Interval (in seconds) for polling the Metadata API for changes")
-	flag.BoolVar(&includeInactive, "include-inactive", false, "Not yet implemented")
+	flag.DurationVar(&retryInitialDelay, "retry-initial-delay", time.Second, "Delay before retrying a failed Metadata request")
+	flag.DurationVar(&retryMaxDelay, "retry-max-delay", time.Minute, "Maximum delay between retries of failed Metadata requests")
+	flag.Float64Var(&retryJitter, "retry-jitter", 0.2, "Randomization factor (0-1) applied to retry delays")
+	flag.DurationVar(&retryMaxElapsed, "retry-max-elapsed", time.Minute, "Time after which to give up retrying at startup and in onetime mode (0 = never)")
+	flag.IntVar(&degradedAfter, "degraded-after", 5, "Number of consecutive Metadata failures after which the status is reported as degraded")
+	flag.BoolVar(&watch, "watch", false, "Block on the Metadata API until the version changes instead of polling at an interval")
+	flag.IntVar(&watchTimeout, "watch-timeout", 30, "Maximum time (in seconds) to wait for a version change in watch mode")
+	flag.BoolVar(&includeInactive, "include-inactive", false, "Include containers that are not running (e.g. stopped or starting)")
+	flag.IntVar(&concurrency, "concurrency", 1, "Maximum number of templates processed in parallel")
+	flag.Var(&wait, "wait", "Minimum and maximum time to wait for Metadata to become stable before rendering (e.g. 5s:30s)")
+	flag.BoolVar(&repairDrift, "repair-drift", false, "Restore destination files that differ from the last rendered content")
+	flag.StringVar(&listen, "listen", "", "Address to serve health checks and metrics on (e.g. :8080)")
+	flag.StringVar(&execCmd, "exec", "", "Command to run and supervise once all templates have been processed")
+	flag.StringVar(&execReloadSignal, "exec-reload-signal", "", "Signal sent to the exec command after templates have been updated. Restarts the command if empty")
+	flag.DurationVar(&execKillTimeout, "exec-kill-timeout", 10*time.Second, "Time to wait for the exec command to exit before killing it on restart")
 	flag.BoolVar(&onetime, "onetime", false, "Process all templates once and exit")
 	flag.StringVar(&logLevel, "log-level", "info", "Verbosity of log output (debug,info,warn,error)")
 	flag.StringVar(&checkCmd, "check-cmd", "", "Command to check the content before updating the destination file.")
 	flag.StringVar(&notifyCmd, "notify-cmd", "", "Command to run after the destination file has been updated.")
 	flag.BoolVar(&notifyOutput, "notify-output", false, "Print the result of the notify command to STDOUT")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory to record the Metadata of every processed version to")
+	flag.IntVar(&recordKeep, "record-keep", 100, "Maximum number of recorded Metadata versions to keep (0 = unlimited)")
+	flag.DurationVar(&recordMaxAge, "record-max-age", 0, "Maximum age of recorded Metadata versions to keep (e.g. 72h, 0 = unlimited)")
+	flag.StringVar(&replayOut, "out", "", "Directory to write the templates rendered by replay to. Printed to STDOUT if omitted")
 	flag.BoolVar(&showVersion, "version", false, "Show application version and exit")
 	flag.Usage = printUsage
-	flag.Parse()
 }
 
 func printUsage() {
 	fmt.Println(`Usage: rancher-gen [options] source [destination]
+       rancher-gen [options] replay directory [version]
 
 Options:`)
 	flag.VisitAll(func(fg *flag.Flag) {
@@ -53,10 +103,17 @@ Options:`)
 	fmt.Println(`
 Arguments:
 	source - Path to the template file
-	dest - Path to the output file. If ommited result is printed to STDOUT.`)
+	dest - Path to the output file. If ommited result is printed to STDOUT.
+
+Commands:
+	replay - Render the configured templates against a Metadata version
+	         recorded with --record-dir. Lists the recorded versions if
+	         the version is omitted.`)
 }
 
 func main() {
+	flag.Parse()
+
 	if showVersion {
 		fmt.Printf("rancher-gen version %s (%s) \n", Version, GitSHA)
 		os.Exit(0)
@@ -67,6 +124,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if flag.Arg(0) == "replay" {
+		replay(flag.Args()[1:])
+		return
+	}
+
 	log.Infof("Starting rancher-gen %s (%s)", Version, GitSHA)
 
 	conf, err := initConfig()
@@ -80,6 +142,80 @@ func main() {
 	}
 
 	if err := r.Run(); err != nil {
+		if e, ok := err.(exitError); ok {
+			os.Exit(e.code)
+		}
+		log.Fatal(err)
+	}
+}
+
+func replay(args []string) {
+	if len(args) < 1 || len(configFile) == 0 {
+		fmt.Println("Usage: rancher-gen --config <file> [options] replay directory [version]")
+		os.Exit(1)
+	}
+
+	dir := args[0]
+	if len(args) == 1 {
+		recordings, err := listRecordings(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range recordings {
+			fmt.Printf("%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.Version, r.Path)
+		}
+		return
+	}
+
+	rec, err := findRecording(dir, args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conf, err := initConfig()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	log.Infof("Replaying Metadata version %s recorded at %s", rec.Version, rec.Time.Format(time.RFC3339))
+
+	// A replay must not touch the destinations and processes of a
+	// running instance.
+	conf.MetadataFile = rec.Path
+	conf.RecordDir = ""
+	conf.OneTime = true
+	conf.Exec = ""
+	conf.Listen = ""
+	for i := range conf.Templates {
+		t := &conf.Templates[i]
+		t.Dest = replayDest(t.Dest)
+		t.CheckCmd = ""
+		t.NotifyCmd = ""
+		t.NotifySignal = ""
+		t.NotifyURL = ""
+		t.NotifyDocker = ""
+	}
+
+	r, err := NewRunner(conf)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err := r.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// replayDest returns the path a replayed template is written to. The
+// destination is mirrored in the --out directory, or the template is
+// printed to STDOUT if no directory is given.
+func replayDest(dest string) string {
+	if replayOut == "" || dest == "" {
+		return ""
+	}
+	path := filepath.Join(replayOut, dest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		log.Fatal(err)
 	}
+	return path
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// requestSender fetches the raw JSON document found at the given
+// Metadata API path.
+type requestSender interface {
+	SendRequest(string) ([]byte, error)
+}
+
+// contextSender is implemented by requestSenders whose requests can be
+// aborted, e.g. long-polling requests for the Metadata version.
+type contextSender interface {
+	SendRequestContext(context.Context, string) ([]byte, error)
+}
+
+// baseClient implements metadata.Client on top of a requestSender.
+type baseClient struct {
+	requestSender
+}
+
+// SendRequestContext sends the request and aborts it once ctx is done,
+// if the requestSender supports it.
+func (c *baseClient) SendRequestContext(ctx context.Context, path string) ([]byte, error) {
+	if sender, ok := c.requestSender.(contextSender); ok {
+		return sender.SendRequestContext(ctx, path)
+	}
+	return c.SendRequest(path)
+}
+
+func (c *baseClient) get(path string, v interface{}) error {
+	resp, err := c.SendRequest(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(resp, v)
+}
+
+func (c *baseClient) OnChange(intervalSeconds int, do func(string)) {
+	interval := time.Duration(intervalSeconds) * time.Second
+	version := "init"
+
+	for {
+		newVersion, err := c.GetVersion()
+		if err != nil {
+			log.Errorf("Error reading metadata version: %v", err)
+			time.Sleep(interval)
+		} else if version == newVersion {
+			log.Debug("No changes in metadata version")
+			time.Sleep(interval)
+		} else {
+			version = newVersion
+			do(newVersion)
+		}
+	}
+}
+
+// GetVersion returns the Metadata version without the JSON quotes the
+// Metadata API returns it with.
+func (c *baseClient) GetVersion() (string, error) {
+	resp, err := c.SendRequest("/version")
+	if err != nil {
+		return "", err
+	}
+	return unquoteVersion(string(resp)), nil
+}
+
+func (c *baseClient) GetSelfHost() (metadata.Host, error) {
+	var host metadata.Host
+	err := c.get("/self/host", &host)
+	return host, err
+}
+
+func (c *baseClient) GetSelfContainer() (metadata.Container, error) {
+	var container metadata.Container
+	err := c.get("/self/container", &container)
+	return container, err
+}
+
+func (c *baseClient) GetSelfServiceByName(name string) (metadata.Service, error) {
+	var service metadata.Service
+	err := c.get("/self/stack/services/"+name, &service)
+	return service, err
+}
+
+func (c *baseClient) GetSelfService() (metadata.Service, error) {
+	var service metadata.Service
+	err := c.get("/self/service", &service)
+	return service, err
+}
+
+func (c *baseClient) GetSelfStack() (metadata.Stack, error) {
+	var stack metadata.Stack
+	err := c.get("/self/stack", &stack)
+	return stack, err
+}
+
+func (c *baseClient) GetServices() ([]metadata.Service, error) {
+	var services []metadata.Service
+	err := c.get("/services", &services)
+	return services, err
+}
+
+func (c *baseClient) GetStacks() ([]metadata.Stack, error) {
+	var stacks []metadata.Stack
+	err := c.get("/stacks", &stacks)
+	return stacks, err
+}
+
+func (c *baseClient) GetContainers() ([]metadata.Container, error) {
+	var containers []metadata.Container
+	err := c.get("/containers", &containers)
+	return containers, err
+}
+
+func (c *baseClient) GetServiceContainers(serviceName string, stackName string) ([]metadata.Container, error) {
+	serviceContainers := []metadata.Container{}
+	containers, err := c.GetContainers()
+	if err != nil {
+		return serviceContainers, err
+	}
+
+	for _, container := range containers {
+		if container.StackName == stackName && container.ServiceName == serviceName {
+			serviceContainers = append(serviceContainers, container)
+		}
+	}
+
+	return serviceContainers, nil
+}
+
+func (c *baseClient) GetHosts() ([]metadata.Host, error) {
+	var hosts []metadata.Host
+	err := c.get("/hosts", &hosts)
+	return hosts, err
+}
+
+func (c *baseClient) GetHost(uuid string) (metadata.Host, error) {
+	hosts, err := c.GetHosts()
+	if err != nil {
+		return metadata.Host{}, err
+	}
+
+	for _, host := range hosts {
+		if host.UUID == uuid {
+			return host, nil
+		}
+	}
+
+	return metadata.Host{}, fmt.Errorf("could not find host by UUID %v", uuid)
+}
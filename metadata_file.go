@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// fileSender serves Metadata API requests from a JSON dump of the
+// Metadata tree, as returned by the API for the version root:
+//
+//	{"services": [...], "containers": [...], "hosts": [...],
+//	 "stacks": [...], "self": {"container": {...}, ...}}
+//
+// The version is the checksum of the file content, so any change to the
+// file is treated as a new version. A version contained in the dump, e.g.
+// in a recording, is only used as label of the version.
+type fileSender struct {
+	path string
+}
+
+func newFileClient(path string) metadata.Client {
+	return &baseClient{&fileSender{path}}
+}
+
+func (f *fileSender) SendRequest(p string) ([]byte, error) {
+	return f.SendRequestContext(context.Background(), p)
+}
+
+// SendRequestContext sends the request like SendRequest. Waiting for the
+// version to change is aborted once ctx is done.
+func (f *fileSender) SendRequestContext(ctx context.Context, p string) ([]byte, error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Path == "/version" {
+		return f.version(ctx, u.Query())
+	}
+
+	buf, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var node interface{}
+	if err := json.Unmarshal(buf, &node); err != nil {
+		return nil, fmt.Errorf("Could not parse metadata file %s: %v", f.path, err)
+	}
+
+	// The version in the tree must match the one served for /version.
+	if root, ok := node.(map[string]interface{}); ok {
+		root["version"] = checksum(buf)
+		if label := dumpLabel(buf); label != "" {
+			root["label"] = label
+		}
+	}
+
+	for _, key := range strings.Split(strings.Trim(u.Path, "/"), "/") {
+		if key == "" {
+			continue
+		}
+		if node = lookupNode(node, key); node == nil {
+			return nil, fmt.Errorf("Error 404 accessing %v path", p)
+		}
+	}
+
+	return json.Marshal(node)
+}
+
+// version returns the version of the metadata file. If the query asks
+// to wait, it blocks until the version differs from the given value or
+// maxWait seconds have passed.
+func (f *fileSender) version(ctx context.Context, query url.Values) ([]byte, error) {
+	version, err := f.fileVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Get("wait") != "true" {
+		return []byte(version), nil
+	}
+
+	maxWait, _ := strconv.Atoi(query.Get("maxWait"))
+	deadline := time.Now().Add(time.Duration(maxWait) * time.Second)
+	for version == query.Get("value") && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if version, err = f.fileVersion(); err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte(version), nil
+}
+
+func (f *fileSender) fileVersion() (string, error) {
+	buf, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("Metadata file %s does not exist", f.path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return checksum(buf), nil
+}
+
+func checksum(buf []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(buf))
+}
+
+// dumpLabel returns the label of the version contained in a Metadata dump,
+// or an empty string if it has none.
+func dumpLabel(buf []byte) string {
+	var root struct {
+		Label   interface{} `json:"label"`
+		Version interface{} `json:"version"`
+	}
+	if json.Unmarshal(buf, &root) != nil {
+		return ""
+	}
+	for _, value := range []interface{}{root.Label, root.Version} {
+		if label, ok := value.(string); ok && label != "" {
+			return label
+		}
+	}
+	return ""
+}
+
+// lookupNode returns the child of a decoded JSON node by key. Like the
+// Metadata API, list items can be referenced by index or by name.
+func lookupNode(node interface{}, key string) interface{} {
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		return typed[key]
+	case []interface{}:
+		if i, err := strconv.Atoi(key); err == nil {
+			if i >= 0 && i < len(typed) {
+				return typed[i]
+			}
+			return nil
+		}
+		for _, item := range typed {
+			if m, ok := item.(map[string]interface{}); ok && m["name"] == key {
+				return item
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.json")
+
+	fetch := func(content string) (string, *TemplateContext) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		client := newFileClient(path)
+		version, err := client.GetVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap, err := (&snapshotFetcher{client: client}).Fetch(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, err := createContext(snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return version, ctx
+	}
+
+	tree := `"services": [], "containers": [], "hosts": [], "stacks": [], "self": {"container": {}}`
+
+	// a dump of the Metadata API contains its version
+	v1, ctx := fetch(`{"version": "7", ` + tree + `}`)
+	if ctx.Version != "7" {
+		t.Errorf("got context version %s, want 7", ctx.Version)
+	}
+
+	// editing the dump is a change even though the version is the same
+	v2, ctx := fetch(`{"version": "7", ` + tree + `, "extra": 1}`)
+	if v2 == v1 {
+		t.Error("version of an edited file did not change")
+	}
+	if ctx.Version != "7" {
+		t.Errorf("got context version %s, want 7", ctx.Version)
+	}
+
+	// without a version, the checksum is used
+	v3, ctx := fetch(`{` + tree + `}`)
+	if ctx.Version != v3 {
+		t.Errorf("got context version %s, want the checksum %s", ctx.Version, v3)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// httpSender sends Metadata API requests to an ordered list of endpoints.
+// Requests are sent to the endpoint that last responded successfully and
+// fail over to the next endpoint on connection errors and server errors.
+type httpSender struct {
+	urls      []string
+	headers   map[string]string
+	timeout   time.Duration
+	transport *http.Transport
+	client    *http.Client
+
+	mu      sync.Mutex
+	current int
+}
+
+func newHTTPClient(conf *Config) (metadata.Client, error) {
+	endpoints := append([]string{conf.MetadataURL}, conf.MetadataFallbackURLs...)
+	urls := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Invalid Metadata URL '%s'", endpoint)
+		}
+		u.Path = path.Join(u.Path, conf.MetadataVersion)
+		urls = append(urls, u.String())
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(conf.MetadataConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	sender := &httpSender{
+		urls:      urls,
+		headers:   conf.MetadataHeaders,
+		timeout:   time.Duration(conf.MetadataTimeout),
+		transport: transport,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(conf.MetadataTimeout),
+		},
+	}
+
+	return &baseClient{sender}, nil
+}
+
+// statusError is returned when the Metadata API responds with an error.
+type statusError struct {
+	StatusCode int
+	Path       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Error %v accessing %v path", e.StatusCode, e.Path)
+}
+
+func (h *httpSender) SendRequest(p string) ([]byte, error) {
+	return h.SendRequestContext(context.Background(), p)
+}
+
+// SendRequestContext sends the request like SendRequest, but aborts it
+// once ctx is done.
+func (h *httpSender) SendRequestContext(ctx context.Context, p string) ([]byte, error) {
+	client := h.client
+	if u, err := url.Parse(p); err == nil && u.Query().Get("wait") == "true" {
+		// Long-polling requests are held open by the server for up
+		// to maxWait seconds on top of the regular request timeout.
+		maxWait, _ := strconv.Atoi(u.Query().Get("maxWait"))
+		client = &http.Client{
+			Transport: h.transport,
+			Timeout:   h.timeout + time.Duration(maxWait)*time.Second,
+		}
+	}
+
+	h.mu.Lock()
+	start := h.current
+	h.mu.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(h.urls); i++ {
+		idx := (start + i) % len(h.urls)
+		body, failover, err := h.send(ctx, client, h.urls[idx], p)
+		if err == nil {
+			h.mu.Lock()
+			if h.current != idx {
+				log.Infof("Switched to Metadata endpoint %s", h.urls[idx])
+				h.current = idx
+			}
+			h.mu.Unlock()
+			return body, nil
+		}
+		if !failover || ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+		if len(h.urls) > 1 {
+			log.Warnf("Metadata endpoint %s failed: %v", h.urls[idx], err)
+		}
+	}
+
+	return nil, lastErr
+}
+
+// send issues the request against a single endpoint. The returned bool
+// reports whether the request should be retried on another endpoint.
+func (h *httpSender) send(ctx context.Context, client *http.Client, baseURL, p string) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+p, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Add("Accept", "application/json")
+	for name, value := range h.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, resp.StatusCode >= 500, &statusError{resp.StatusCode, p}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return body, false, nil
+}
+
+// waitForMetadata blocks until the Metadata API responds or the retry
+// policy gives up.
+func waitForMetadata(client metadata.Client, policy retryPolicy) error {
+	return retry(policy, func() error {
+		_, err := client.GetVersion()
+		if err != nil {
+			log.Debugf("Waiting for Metadata API: %v", err)
+		}
+		return err
+	})
+}
+
+// headerFlags collects repeated 'Name: value' command line flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	pairs := make([]string, 0, len(h))
+	for name, value := range h {
+		pairs = append(pairs, name+": "+value)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (h headerFlags) Set(v string) error {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("header must have the format 'Name: value'")
+	}
+	h[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn is a Metadata API stand-in that answers after a delay with a
+// fixed status and body and counts the requests it received.
+type standIn struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	status   int
+	body     string
+	requests int
+	header   http.Header
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.header = req.Header
+	delay, status, body := s.delay, s.status, s.body
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-req.Context().Done():
+		return
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	w.Write([]byte(body))
+}
+
+func (s *standIn) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newTestSender(t *testing.T, urls ...string) *httpSender {
+	conf := &Config{
+		MetadataURL:            urls[0],
+		MetadataFallbackURLs:   urls[1:],
+		MetadataVersion:        "latest",
+		MetadataTimeout:        duration(200 * time.Millisecond),
+		MetadataConnectTimeout: duration(200 * time.Millisecond),
+		MetadataHeaders:        map[string]string{"X-Test": "yes"},
+	}
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*baseClient).requestSender.(*httpSender)
+}
+
+func TestHTTPSenderFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		primary  *standIn
+		failover bool
+	}{
+		{"timeout", &standIn{delay: time.Second, body: "primary"}, true},
+		{"server error", &standIn{status: http.StatusServiceUnavailable}, true},
+		{"client error", &standIn{status: http.StatusNotFound}, false},
+	}
+
+	for _, test := range tests {
+		primary := httptest.NewServer(test.primary)
+		fallback := &standIn{body: "fallback"}
+		fallbackServer := httptest.NewServer(fallback)
+		sender := newTestSender(t, primary.URL, fallbackServer.URL)
+
+		start := time.Now()
+		body, err := sender.SendRequest("/version")
+		if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+			t.Errorf("%s: request took %v", test.name, elapsed)
+		}
+
+		if test.failover {
+			if err != nil || string(body) != "fallback" {
+				t.Errorf("%s: got %q, %v, want response of fallback endpoint", test.name, body, err)
+			}
+			// the endpoint that responded is used for subsequent requests
+			sender.SendRequest("/version")
+			if n := test.primary.count(); n != 1 {
+				t.Errorf("%s: primary endpoint received %d requests, want 1", test.name, n)
+			}
+			if n := fallback.count(); n != 2 {
+				t.Errorf("%s: fallback endpoint received %d requests, want 2", test.name, n)
+			}
+		} else {
+			if e, ok := err.(*statusError); !ok || e.StatusCode != http.StatusNotFound {
+				t.Errorf("%s: got error %v, want status error 404", test.name, err)
+			}
+			if n := fallback.count(); n != 0 {
+				t.Errorf("%s: fallback endpoint received %d requests, want 0", test.name, n)
+			}
+		}
+
+		primary.Close()
+		fallbackServer.Close()
+	}
+}
+
+func TestHTTPSenderConnectFailure(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	fallback := &standIn{body: "fallback"}
+	server := httptest.NewServer(fallback)
+	defer server.Close()
+
+	body, err := newTestSender(t, closed.URL, server.URL).SendRequest("/version")
+	if err != nil || string(body) != "fallback" {
+		t.Errorf("got %q, %v, want response of fallback endpoint", body, err)
+	}
+	if got := fallback.header.Get("X-Test"); got != "yes" {
+		t.Errorf("got header X-Test %q, want \"yes\"", got)
+	}
+}
+
+func TestHTTPSenderAllEndpointsFail(t *testing.T) {
+	slow := &standIn{delay: time.Second}
+	first := httptest.NewServer(slow)
+	defer first.Close()
+	second := httptest.NewServer(slow)
+	defer second.Close()
+
+	start := time.Now()
+	if _, err := newTestSender(t, first.URL, second.URL).SendRequest("/version"); err == nil {
+		t.Error("request to unresponsive endpoints succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("request took %v, want about two timeouts", elapsed)
+	}
+}
+
+func TestHTTPSenderLongPollTimeout(t *testing.T) {
+	// The server holds the watch request longer than the request timeout,
+	// but within maxWait.
+	server := httptest.NewServer(&standIn{delay: 500 * time.Millisecond, body: "2"})
+	defer server.Close()
+
+	body, err := newTestSender(t, server.URL).SendRequest("/version?wait=true&value=1&maxWait=1")
+	if err != nil || string(body) != "2" {
+		t.Errorf("got %q, %v, want \"2\"", body, err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics collects the measurements exposed in the Prometheus text format
+// on /metrics. It is safe for concurrent use.
+var metrics = newMetricSet()
+
+// summary is a Prometheus summary without quantiles.
+type summary struct {
+	sum   float64
+	count int
+}
+
+func (s *summary) observe(d time.Duration) {
+	s.sum += d.Seconds()
+	s.count++
+}
+
+type templateMetrics struct {
+	renders        int
+	failures       int
+	checkFailures  int
+	notifyFailures int
+	duration       summary
+	bytes          int
+	lastSuccess    time.Time
+}
+
+type metricSet struct {
+	mu            sync.Mutex
+	version       string
+	poll          summary
+	pollErrors    int
+	fetch         summary
+	fetchErrors   int
+	templates     map[string]*templateMetrics
+	templateOrder []string
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{templates: make(map[string]*templateMetrics)}
+}
+
+// ObservePoll records a query of the Metadata version.
+func (m *metricSet) ObservePoll(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.poll.observe(d)
+	if err != nil {
+		m.pollErrors++
+	}
+}
+
+// ObserveFetch records a fetch of the Metadata.
+func (m *metricSet) ObserveFetch(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fetch.observe(d)
+	if err != nil {
+		m.fetchErrors++
+	}
+}
+
+// SetVersion records the current Metadata version.
+func (m *metricSet) SetVersion(version string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.version = version
+}
+
+// ObserveRender records the processing of a template.
+func (m *metricSet) ObserveRender(source string, d time.Duration, bytes int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.template(source)
+	t.renders++
+	t.duration.observe(d)
+	if err != nil {
+		t.failures++
+		return
+	}
+	t.bytes = bytes
+	t.lastSuccess = time.Now()
+}
+
+// CheckFailed records a failed check command of a template.
+func (m *metricSet) CheckFailed(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.template(source).checkFailures++
+}
+
+// NotifyFailed records a failed notify command of a template.
+func (m *metricSet) NotifyFailed(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.template(source).notifyFailures++
+}
+
+func (m *metricSet) template(source string) *templateMetrics {
+	t, ok := m.templates[source]
+	if !ok {
+		t = &templateMetrics{}
+		m.templates[source] = t
+		m.templateOrder = append(m.templateOrder, source)
+		sort.Strings(m.templateOrder)
+	}
+	return t
+}
+
+// WriteTo writes the metrics and the given status in the Prometheus text
+// exposition format.
+func (m *metricSet) WriteTo(w io.Writer, st runnerStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := &promWriter{w: w}
+
+	p.metric("rancher_gen_metadata_version_info", "gauge", "Current Metadata version.")
+	if m.version != "" {
+		p.sample("rancher_gen_metadata_version_info", labels("version", m.version), 1)
+	}
+	p.metric("rancher_gen_metadata_degraded", "gauge", "Whether the Metadata API is failing repeatedly.")
+	p.sample("rancher_gen_metadata_degraded", "", boolValue(st.Degraded))
+	p.metric("rancher_gen_metadata_consecutive_failures", "gauge", "Number of consecutive failed Metadata queries.")
+	p.sample("rancher_gen_metadata_consecutive_failures", "", float64(st.ConsecutiveFailures))
+
+	p.summary("rancher_gen_metadata_poll_duration_seconds", "Duration of Metadata version queries.", "", m.poll)
+	p.metric("rancher_gen_metadata_poll_errors_total", "counter", "Number of failed Metadata version queries.")
+	p.sample("rancher_gen_metadata_poll_errors_total", "", float64(m.pollErrors))
+	p.summary("rancher_gen_metadata_fetch_duration_seconds", "Duration of Metadata fetches.", "", m.fetch)
+	p.metric("rancher_gen_metadata_fetch_errors_total", "counter", "Number of failed Metadata fetches.")
+	p.sample("rancher_gen_metadata_fetch_errors_total", "", float64(m.fetchErrors))
+
+	templateSamples := []struct {
+		name, kind, help string
+		value            func(*templateMetrics) float64
+	}{
+		{"rancher_gen_template_renders_total", "counter", "Number of times the template was processed.",
+			func(t *templateMetrics) float64 { return float64(t.renders) }},
+		{"rancher_gen_template_failures_total", "counter", "Number of times processing the template failed.",
+			func(t *templateMetrics) float64 { return float64(t.failures) }},
+		{"rancher_gen_template_check_failures_total", "counter", "Number of failed check commands.",
+			func(t *templateMetrics) float64 { return float64(t.checkFailures) }},
+		{"rancher_gen_template_notify_failures_total", "counter", "Number of failed notify commands.",
+			func(t *templateMetrics) float64 { return float64(t.notifyFailures) }},
+		{"rancher_gen_template_bytes", "gauge", "Size of the last rendered content.",
+			func(t *templateMetrics) float64 { return float64(t.bytes) }},
+		{"rancher_gen_template_last_success_timestamp_seconds", "gauge", "Time the template was last processed successfully.",
+			func(t *templateMetrics) float64 { return timestamp(t.lastSuccess) }},
+	}
+	for _, s := range templateSamples {
+		p.metric(s.name, s.kind, s.help)
+		for _, source := range m.templateOrder {
+			p.sample(s.name, labels("template", source), s.value(m.templates[source]))
+		}
+	}
+
+	p.metric("rancher_gen_template_render_duration_seconds", "summary", "Duration of processing the template.")
+	for _, source := range m.templateOrder {
+		p.summarySamples("rancher_gen_template_render_duration_seconds", labels("template", source), m.templates[source].duration)
+	}
+}
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	w io.Writer
+}
+
+func (p *promWriter) metric(name, kind, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (p *promWriter) sample(name, labels string, value float64) {
+	fmt.Fprintf(p.w, "%s%s %g\n", name, labels, value)
+}
+
+func (p *promWriter) summary(name, help, labels string, s summary) {
+	p.metric(name, "summary", help)
+	p.summarySamples(name, labels, s)
+}
+
+func (p *promWriter) summarySamples(name, labels string, s summary) {
+	p.sample(name+"_sum", labels, s.sum)
+	p.sample(name+"_count", labels, float64(s.count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(name, value string) string {
+	return fmt.Sprintf(`{%s="%s"}`, name, labelEscaper.Replace(value))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
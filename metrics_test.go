@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+const expectedMetrics = `# HELP rancher_gen_metadata_version_info Current Metadata version.
+# TYPE rancher_gen_metadata_version_info gauge
+rancher_gen_metadata_version_info{version="7"} 1
+# HELP rancher_gen_metadata_degraded Whether the Metadata API is failing repeatedly.
+# TYPE rancher_gen_metadata_degraded gauge
+rancher_gen_metadata_degraded 1
+# HELP rancher_gen_metadata_consecutive_failures Number of consecutive failed Metadata queries.
+# TYPE rancher_gen_metadata_consecutive_failures gauge
+rancher_gen_metadata_consecutive_failures 3
+# HELP rancher_gen_metadata_poll_duration_seconds Duration of Metadata version queries.
+# TYPE rancher_gen_metadata_poll_duration_seconds summary
+rancher_gen_metadata_poll_duration_seconds_sum 0.75
+rancher_gen_metadata_poll_duration_seconds_count 2
+# HELP rancher_gen_metadata_poll_errors_total Number of failed Metadata version queries.
+# TYPE rancher_gen_metadata_poll_errors_total counter
+rancher_gen_metadata_poll_errors_total 1
+# HELP rancher_gen_metadata_fetch_duration_seconds Duration of Metadata fetches.
+# TYPE rancher_gen_metadata_fetch_duration_seconds summary
+rancher_gen_metadata_fetch_duration_seconds_sum 1.5
+rancher_gen_metadata_fetch_duration_seconds_count 1
+# HELP rancher_gen_metadata_fetch_errors_total Number of failed Metadata fetches.
+# TYPE rancher_gen_metadata_fetch_errors_total counter
+rancher_gen_metadata_fetch_errors_total 0
+# HELP rancher_gen_template_renders_total Number of times the template was processed.
+# TYPE rancher_gen_template_renders_total counter
+rancher_gen_template_renders_total{template="/etc/\"quoted\"\\path\n.tmpl"} 1
+rancher_gen_template_renders_total{template="app.tmpl"} 2
+# HELP rancher_gen_template_failures_total Number of times processing the template failed.
+# TYPE rancher_gen_template_failures_total counter
+rancher_gen_template_failures_total{template="/etc/\"quoted\"\\path\n.tmpl"} 1
+rancher_gen_template_failures_total{template="app.tmpl"} 1
+# HELP rancher_gen_template_check_failures_total Number of failed check commands.
+# TYPE rancher_gen_template_check_failures_total counter
+rancher_gen_template_check_failures_total{template="/etc/\"quoted\"\\path\n.tmpl"} 0
+rancher_gen_template_check_failures_total{template="app.tmpl"} 1
+# HELP rancher_gen_template_notify_failures_total Number of failed notify commands.
+# TYPE rancher_gen_template_notify_failures_total counter
+rancher_gen_template_notify_failures_total{template="/etc/\"quoted\"\\path\n.tmpl"} 1
+rancher_gen_template_notify_failures_total{template="app.tmpl"} 0
+# HELP rancher_gen_template_bytes Size of the last rendered content.
+# TYPE rancher_gen_template_bytes gauge
+rancher_gen_template_bytes{template="/etc/\"quoted\"\\path\n.tmpl"} 0
+rancher_gen_template_bytes{template="app.tmpl"} 512
+# HELP rancher_gen_template_last_success_timestamp_seconds Time the template was last processed successfully.
+# TYPE rancher_gen_template_last_success_timestamp_seconds gauge
+rancher_gen_template_last_success_timestamp_seconds{template="/etc/\"quoted\"\\path\n.tmpl"} 0
+rancher_gen_template_last_success_timestamp_seconds{template="app.tmpl"} 1.4767e+09
+# HELP rancher_gen_template_render_duration_seconds Duration of processing the template.
+# TYPE rancher_gen_template_render_duration_seconds summary
+rancher_gen_template_render_duration_seconds_sum{template="/etc/\"quoted\"\\path\n.tmpl"} 0.25
+rancher_gen_template_render_duration_seconds_count{template="/etc/\"quoted\"\\path\n.tmpl"} 1
+rancher_gen_template_render_duration_seconds_sum{template="app.tmpl"} 1
+rancher_gen_template_render_duration_seconds_count{template="app.tmpl"} 2
+`
+
+func TestWriteMetrics(t *testing.T) {
+	m := newMetricSet()
+	failed := errors.New("failed")
+
+	m.SetVersion("7")
+	m.ObservePoll(250*time.Millisecond, nil)
+	m.ObservePoll(500*time.Millisecond, failed)
+	m.ObserveFetch(1500*time.Millisecond, nil)
+
+	m.ObserveRender("app.tmpl", 500*time.Millisecond, 1024, failed)
+	m.CheckFailed("app.tmpl")
+	m.ObserveRender("app.tmpl", 500*time.Millisecond, 512, nil)
+	m.templates["app.tmpl"].lastSuccess = time.Unix(1476700000, 0)
+
+	quoted := "/etc/\"quoted\"\\path\n.tmpl"
+	m.ObserveRender(quoted, 250*time.Millisecond, 0, failed)
+	m.NotifyFailed(quoted)
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf, runnerStatus{Degraded: true, ConsecutiveFailures: 3})
+	if buf.String() != expectedMetrics {
+		t.Errorf("got metrics:\n%s\nwant:\n%s", buf.String(), expectedMetrics)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultDockerSocket  = "/var/run/docker.sock"
+	defaultDockerSignal  = "SIGHUP"
+	defaultDockerTimeout = time.Minute
+
+	// Labels Rancher sets on the containers of a sidekick group
+	deploymentUnitLabel = "io.rancher.service.deployment.unit"
+	launchConfigLabel   = "io.rancher.service.launch.config"
+	primaryLaunchConfig = "io.rancher.service.primary.launch.config"
+)
+
+// errNoContainer means that no container matches the notify target.
+var errNoContainer = errors.New("no matching container")
+
+// dockerError is returned when the Docker API responds with an error.
+type dockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("Docker API error %d: %s", e.StatusCode, e.Message)
+}
+
+// notifyDockerError is returned when a container could not be notified.
+type notifyDockerError struct {
+	Action string
+	Target string // container name, label or primary container
+	Err    error
+}
+
+func (e *notifyDockerError) Error() string {
+	return fmt.Sprintf("Could not %s %s: %v", e.Action, e.Target, e.Err)
+}
+
+// dockerClient is a minimal client for the Docker Engine API listening
+// on a unix socket.
+type dockerClient struct {
+	client *http.Client
+}
+
+func newDockerClient(socket string, timeout time.Duration) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{&http.Client{Transport: transport, Timeout: timeout}}
+}
+
+// do sends a request to the Docker API and decodes the JSON response
+// into out, unless out is nil.
+func (d *dockerClient) do(method, path string, query url.Values, in, out interface{}) error {
+	resp, err := d.request(method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (d *dockerClient) request(method, path string, query url.Values, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	u := "http://docker" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(buf, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(buf))
+		}
+		return nil, &dockerError{resp.StatusCode, msg.Message}
+	}
+	return resp, nil
+}
+
+// ContainersByLabel returns the IDs of the running containers that have
+// the label ('key=value' or 'key').
+func (d *dockerClient) ContainersByLabel(label string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []struct {
+		Id string
+	}
+	query := url.Values{"filters": {string(filters)}}
+	if err := d.do("GET", "/containers/json", query, nil, &containers); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.Id)
+	}
+	return ids, nil
+}
+
+// Kill sends the signal to the container.
+func (d *dockerClient) Kill(id, signal string) error {
+	return d.do("POST", "/containers/"+url.PathEscape(id)+"/kill", url.Values{"signal": {signal}}, nil, nil)
+}
+
+// Restart restarts the container.
+func (d *dockerClient) Restart(id string) error {
+	return d.do("POST", "/containers/"+url.PathEscape(id)+"/restart", nil, nil, nil)
+}
+
+// Exec runs the command in the container and returns its combined output.
+// It returns an error if the command exits with a non-zero status.
+func (d *dockerClient) Exec(id string, cmd []string) ([]byte, error) {
+	var created struct {
+		Id string
+	}
+	config := map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          cmd,
+	}
+	if err := d.do("POST", "/containers/"+url.PathEscape(id)+"/exec", nil, config, &created); err != nil {
+		return nil, err
+	}
+
+	start := map[string]bool{"Detach": false, "Tty": false}
+	resp, err := d.request("POST", "/exec/"+url.PathEscape(created.Id)+"/start", nil, start)
+	if err != nil {
+		return nil, err
+	}
+	output, err := readDockerStream(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return output, err
+	}
+
+	var inspect struct {
+		ExitCode int
+	}
+	if err := d.do("GET", "/exec/"+url.PathEscape(created.Id)+"/json", nil, nil, &inspect); err != nil {
+		return output, err
+	}
+	if inspect.ExitCode != 0 {
+		return output, fmt.Errorf("exit status %d", inspect.ExitCode)
+	}
+	return output, nil
+}
+
+// readDockerStream reads the output of an exec started without a TTY, in
+// which Docker prefixes each frame with its stream type and size.
+func readDockerStream(r io.Reader) ([]byte, error) {
+	var output bytes.Buffer
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return output.Bytes(), nil
+			}
+			return output.Bytes(), err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(&output, r, size); err != nil {
+			return output.Bytes(), err
+		}
+	}
+}
+
+// notifyDocker notifies the containers targeted by the template through
+// the Docker API.
+func notifyDocker(logger *log.Entry, client *dockerClient, t Template, ctx *TemplateContext) error {
+	action := strings.ToLower(t.NotifyDocker)
+	target, ids, err := dockerTargets(client, t, ctx)
+	if err != nil {
+		return &notifyDockerError{action, target, err}
+	}
+
+	for _, id := range ids {
+		switch action {
+		case "signal":
+			signal := t.NotifyDockerSignal
+			if signal == "" {
+				signal = defaultDockerSignal
+			}
+			logger.Infof("Sending %s to container %s (%s)", signal, id, target)
+			err = client.Kill(id, signal)
+		case "restart":
+			logger.Infof("Restarting container %s (%s)", id, target)
+			err = client.Restart(id)
+		case "exec":
+			logger.Infof("Running '%s' in container %s (%s)", strings.Join(t.NotifyDockerCmd, " "), id, target)
+			var output []byte
+			output, err = client.Exec(id, t.NotifyDockerCmd)
+			if err != nil || t.NotifyOutput {
+				logCmdOutput(logger, strings.Join(t.NotifyDockerCmd, " "), output)
+			}
+		}
+		if err != nil {
+			if t.NotifyDockerContainer == "" {
+				err = fmt.Errorf("container %s: %v", id, err)
+			}
+			return &notifyDockerError{action, target, err}
+		}
+	}
+
+	return nil
+}
+
+// dockerTargets returns a description of the notify target of the
+// template and the names or IDs of the matching containers.
+func dockerTargets(client *dockerClient, t Template, ctx *TemplateContext) (string, []string, error) {
+	switch {
+	case t.NotifyDockerContainer != "":
+		return "container " + t.NotifyDockerContainer, []string{t.NotifyDockerContainer}, nil
+	case t.NotifyDockerLabel != "":
+		target := "containers with label " + t.NotifyDockerLabel
+		ids, err := client.ContainersByLabel(t.NotifyDockerLabel)
+		if err == nil && len(ids) == 0 {
+			err = errNoContainer
+		}
+		return target, ids, err
+	default:
+		target := "primary container"
+		c, err := primaryContainer(ctx)
+		if err != nil {
+			return target, nil, err
+		}
+		return target + " " + c.Name, []string{c.ExternalId}, nil
+	}
+}
+
+// primaryContainer returns the container of the primary service in the
+// sidekick group of the container rancher-gen is running in.
+func primaryContainer(ctx *TemplateContext) (Container, error) {
+	if ctx == nil {
+		return Container{}, errNoContainer
+	}
+	unit := ctx.Self.Container.Labels.GetValue(deploymentUnitLabel)
+	if unit == "" {
+		return Container{}, fmt.Errorf("container %s is not part of a sidekick group", ctx.Self.Container.Name)
+	}
+
+	for _, c := range ctx.Containers {
+		if c.Labels.GetValue(deploymentUnitLabel) == unit &&
+			c.Labels.GetValue(launchConfigLabel) == primaryLaunchConfig &&
+			c.ExternalId != "" {
+			return c, nil
+		}
+	}
+	return Container{}, errNoContainer
+}
+
+func validateNotifyDocker(t Template) error {
+	if t.NotifyDocker == "" {
+		if t.NotifyDockerContainer != "" || t.NotifyDockerLabel != "" || t.NotifyDockerPrimary {
+			return fmt.Errorf("notify-docker is required with notify-docker-container, notify-docker-label and notify-docker-primary")
+		}
+		return nil
+	}
+
+	switch strings.ToLower(t.NotifyDocker) {
+	case "signal":
+		if t.NotifyDockerSignal != "" {
+			if _, err := parseSignal(t.NotifyDockerSignal); err != nil {
+				return err
+			}
+		}
+	case "restart":
+	case "exec":
+		if len(t.NotifyDockerCmd) == 0 {
+			return fmt.Errorf("notify-docker-cmd is required with notify-docker = \"exec\"")
+		}
+	default:
+		return fmt.Errorf("Invalid notify-docker action '%s' (signal, restart or exec)", t.NotifyDocker)
+	}
+
+	targets := 0
+	for _, set := range []bool{t.NotifyDockerContainer != "", t.NotifyDockerLabel != "", t.NotifyDockerPrimary} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return fmt.Errorf("notify-docker requires one of notify-docker-container, notify-docker-label or notify-docker-primary")
+	}
+	if t.NotifyTimeout < 0 {
+		return fmt.Errorf("notify-timeout must not be negative")
+	}
+	return nil
+}
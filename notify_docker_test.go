@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fakeDocker is a Docker Engine API on a unix socket. It knows the running
+// containers by ID and name and records the requests it received.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers map[string]map[string]string // ID => labels
+	names      map[string]string            // name => ID
+	exitCode   int                          // of exec commands
+	requests   []string
+	execCmds   [][]string
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, string, func()) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeDocker{
+		containers: map[string]map[string]string{
+			"dockerid1": {"app": "nginx"},
+			"dockerid2": {"app": "nginx"},
+			"dockerid3": {"app": "db"},
+		},
+		names: map[string]string{"nginx": "dockerid1"},
+	}
+	server := httptest.NewUnstartedServer(fake)
+	server.Listener = listener
+	server.Start()
+
+	return fake, socket, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.RequestURI())
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/containers/json":
+		var filters map[string][]string
+		json.Unmarshal([]byte(req.URL.Query().Get("filters")), &filters)
+		label := strings.SplitN(filters["label"][0], "=", 2)
+		result := []map[string]string{}
+		for _, id := range []string{"dockerid1", "dockerid2", "dockerid3"} {
+			if value, ok := f.containers[id][label[0]]; ok && (len(label) == 1 || value == label[1]) {
+				result = append(result, map[string]string{"Id": id})
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	case len(parts) == 3 && parts[0] == "containers":
+		id := parts[1]
+		if named, ok := f.names[id]; ok {
+			id = named
+		}
+		if _, ok := f.containers[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "No such container: ` + parts[1] + `"}`))
+			return
+		}
+		switch parts[2] {
+		case "kill", "restart":
+			w.WriteHeader(http.StatusNoContent)
+		case "exec":
+			var config struct{ Cmd []string }
+			json.NewDecoder(req.Body).Decode(&config)
+			f.execCmds = append(f.execCmds, config.Cmd)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id": "exec1"}`))
+		}
+	case req.Method == "POST" && req.URL.Path == "/exec/exec1/start":
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		writeFrame(w, 1, "reloaded\n")
+		writeFrame(w, 2, "warning\n")
+	case req.Method == "GET" && req.URL.Path == "/exec/exec1/json":
+		json.NewEncoder(w).Encode(map[string]interface{}{"Running": false, "ExitCode": f.exitCode})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// writeFrame writes a frame of a multiplexed exec output stream.
+func writeFrame(w http.ResponseWriter, stream byte, data string) {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	w.Write(header)
+	w.Write([]byte(data))
+}
+
+func (f *fakeDocker) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// sidekickContext returns Metadata in which rancher-gen runs as a sidekick
+// of the container with the Docker ID dockerid2.
+func sidekickContext() *TemplateContext {
+	unit := func(unit, launchConfig string) LabelMap {
+		return LabelMap{deploymentUnitLabel: unit, launchConfigLabel: launchConfig}
+	}
+	self := Container{Name: "web_config_1", ExternalId: "dockerid9", Labels: unit("u2", "config")}
+	return &TemplateContext{
+		Self: Self{Container: self},
+		Containers: []Container{
+			{Name: "web_1", ExternalId: "dockerid1", Labels: unit("u1", primaryLaunchConfig)},
+			{Name: "web_config_2", ExternalId: "dockerid8", Labels: unit("u1", "config")},
+			{Name: "web_2", ExternalId: "dockerid2", Labels: unit("u2", primaryLaunchConfig)},
+			self,
+		},
+	}
+}
+
+func TestNotifyDocker(t *testing.T) {
+	tests := []struct {
+		name     string
+		tmpl     Template
+		requests []string
+	}{
+		{
+			name:     "signal primary container",
+			tmpl:     Template{NotifyDocker: "signal", NotifyDockerPrimary: true, NotifyDockerSignal: "SIGUSR1"},
+			requests: []string{"POST /containers/dockerid2/kill?signal=SIGUSR1"},
+		},
+		{
+			name:     "default signal",
+			tmpl:     Template{NotifyDocker: "signal", NotifyDockerContainer: "nginx"},
+			requests: []string{"POST /containers/nginx/kill?signal=SIGHUP"},
+		},
+		{
+			name: "restart by label",
+			tmpl: Template{NotifyDocker: "restart", NotifyDockerLabel: "app=nginx"},
+			requests: []string{
+				`GET /containers/json?filters=%7B%22label%22%3A%5B%22app%3Dnginx%22%5D%7D`,
+				"POST /containers/dockerid1/restart",
+				"POST /containers/dockerid2/restart",
+			},
+		},
+		{
+			name: "exec in container",
+			tmpl: Template{NotifyDocker: "exec", NotifyDockerContainer: "nginx", NotifyDockerCmd: []string{"nginx", "-s", "reload"}},
+			requests: []string{
+				"POST /containers/nginx/exec",
+				"POST /exec/exec1/start",
+				"GET /exec/exec1/json",
+			},
+		},
+	}
+
+	logger := log.WithField("template", "app.tmpl")
+	for _, test := range tests {
+		fake, socket, stop := newFakeDocker(t)
+		if err := validateNotifyDocker(test.tmpl); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if err := notifyDocker(logger, newDockerClient(socket, time.Second), test.tmpl, sidekickContext()); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if got := fake.sent(); strings.Join(got, "\n") != strings.Join(test.requests, "\n") {
+			t.Errorf("%s: sent requests %q, want %q", test.name, got, test.requests)
+		}
+		if len(fake.execCmds) > 0 && strings.Join(fake.execCmds[0], " ") != "nginx -s reload" {
+			t.Errorf("%s: got exec command %q", test.name, fake.execCmds[0])
+		}
+		stop()
+	}
+}
+
+func TestNotifyDockerErrors(t *testing.T) {
+	notInGroup := sidekickContext()
+	notInGroup.Self.Container.Labels = LabelMap{}
+	noPrimary := sidekickContext()
+	noPrimary.Containers = noPrimary.Containers[:2]
+
+	tests := []struct {
+		name     string
+		tmpl     Template
+		ctx      *TemplateContext
+		exitCode int
+		err      string
+	}{
+		{"unknown container", Template{NotifyDocker: "restart", NotifyDockerContainer: "missing"}, sidekickContext(), 0,
+			"Could not restart container missing: Docker API error 404: No such container: missing"},
+		{"no matching label", Template{NotifyDocker: "signal", NotifyDockerLabel: "app=none"}, sidekickContext(), 0,
+			"Could not signal containers with label app=none: no matching container"},
+		{"not a sidekick", Template{NotifyDocker: "signal", NotifyDockerPrimary: true}, notInGroup, 0,
+			"Could not signal primary container: container web_config_1 is not part of a sidekick group"},
+		{"no primary container", Template{NotifyDocker: "signal", NotifyDockerPrimary: true}, noPrimary, 0,
+			"Could not signal primary container: no matching container"},
+		{"exec fails", Template{NotifyDocker: "exec", NotifyDockerContainer: "nginx", NotifyDockerCmd: []string{"false"}}, sidekickContext(), 1,
+			"Could not exec container nginx: exit status 1"},
+	}
+
+	logger := log.WithField("template", "app.tmpl")
+	for _, test := range tests {
+		fake, socket, stop := newFakeDocker(t)
+		fake.exitCode = test.exitCode
+		err := notifyDocker(logger, newDockerClient(socket, time.Second), test.tmpl, test.ctx)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+		stop()
+	}
+}
+
+func TestDockerExecOutput(t *testing.T) {
+	_, socket, stop := newFakeDocker(t)
+	defer stop()
+
+	output, err := newDockerClient(socket, time.Second).Exec("nginx", []string{"nginx", "-s", "reload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "reloaded\nwarning\n" {
+		t.Errorf("got output %q, want the demultiplexed stdout and stderr", output)
+	}
+}
+
+func TestValidateNotifyDocker(t *testing.T) {
+	tests := []struct {
+		tmpl Template
+		err  bool
+	}{
+		{Template{}, false},
+		{Template{NotifyDocker: "signal", NotifyDockerPrimary: true}, false},
+		{Template{NotifyDocker: "Restart", NotifyDockerLabel: "app"}, false},
+		{Template{NotifyDocker: "exec", NotifyDockerContainer: "nginx", NotifyDockerCmd: []string{"true"}}, false},
+		{Template{NotifyDockerContainer: "nginx"}, true},
+		{Template{NotifyDocker: "stop", NotifyDockerContainer: "nginx"}, true},
+		{Template{NotifyDocker: "signal"}, true},
+		{Template{NotifyDocker: "signal", NotifyDockerContainer: "nginx", NotifyDockerPrimary: true}, true},
+		{Template{NotifyDocker: "signal", NotifyDockerContainer: "nginx", NotifyDockerSignal: "SIGFOO"}, true},
+		{Template{NotifyDocker: "exec", NotifyDockerContainer: "nginx"}, true},
+	}
+
+	for _, test := range tests {
+		if err := validateNotifyDocker(test.tmpl); (err != nil) != test.err {
+			t.Errorf("%+v: got error %v, want error: %t", test.tmpl, err, test.err)
+		}
+	}
+}
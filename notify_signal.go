@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// errStalePidfile means that the process referenced by a pidfile
+	// does not exist.
+	errStalePidfile = errors.New("no process with the pid in the pidfile")
+	// errNoProcess means that no process matches the process name.
+	errNoProcess = errors.New("no matching process")
+)
+
+// notifySignalError is returned when a notify signal could not be sent.
+type notifySignalError struct {
+	Signal syscall.Signal
+	Target string // pidfile or process name
+	Err    error
+}
+
+func (e *notifySignalError) Error() string {
+	return fmt.Sprintf("Could not send %v to %s: %v", e.Signal, e.Target, e.Err)
+}
+
+// notifySignal sends the notify signal of the template to the process
+// referenced by the pidfile or to the processes matching the process name.
+func notifySignal(logger *log.Entry, t Template) error {
+	sig, err := parseSignal(t.NotifySignal)
+	if err != nil {
+		return err
+	}
+
+	var target string
+	var pids []int
+	if t.NotifyPidfile != "" {
+		target = "pidfile " + t.NotifyPidfile
+		var pid int
+		pid, err = readPidfile(t.NotifyPidfile)
+		pids = []int{pid}
+	} else {
+		target = "process " + t.NotifyProcess
+		pids, err = findProcesses(t.NotifyProcess)
+	}
+	if err != nil {
+		return &notifySignalError{sig, target, err}
+	}
+
+	for _, pid := range pids {
+		logger.Infof("Sending %v to pid %d (%s)", sig, pid, target)
+		if err := syscall.Kill(pid, sig); err != nil {
+			return &notifySignalError{sig, target, fmt.Errorf("pid %d: %v", pid, err)}
+		}
+	}
+
+	return nil
+}
+
+// readPidfile returns the pid in the pidfile after checking that the
+// process exists.
+func readPidfile(path string) (int, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid '%s'", strings.TrimSpace(string(buf)))
+	}
+
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return 0, errStalePidfile
+	}
+
+	return pid, nil
+}
+
+// findProcesses returns the pids of the processes with the given name.
+// If the parent of a matching process matches as well (e.g. the worker
+// processes of nginx), only the parent is returned.
+func findProcesses(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[int]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if ppid, ok := matchProcess(pid, name); ok {
+			parents[pid] = ppid
+		}
+	}
+
+	var pids []int
+	for pid, ppid := range parents {
+		if _, ok := parents[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, errNoProcess
+	}
+
+	return pids, nil
+}
+
+// matchProcess returns the parent pid of the process if its name or
+// executable matches the given name. Zombie processes do not match.
+func matchProcess(pid int, name string) (int, bool) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, false
+	}
+
+	// The name in parentheses may contain spaces and parentheses itself.
+	start := strings.IndexByte(string(stat), '(')
+	end := strings.LastIndexByte(string(stat), ')')
+	if start < 0 || end < start {
+		return 0, false
+	}
+	comm := string(stat[start+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 2 || fields[0] == "Z" {
+		return 0, false
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+
+	if comm == name {
+		return ppid, true
+	}
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return 0, false
+	}
+	argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+	return ppid, argv0 != "" && filepath.Base(argv0) == name
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// copyShell copies the shell to dir under the given name, so processes
+// with a unique name can be started.
+func copyShell(t *testing.T, dir, name string) string {
+	t.Helper()
+	buf, err := ioutil.ReadFile("/bin/sh")
+	if err != nil {
+		t.Skipf("Cannot copy the shell: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, buf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startProcess starts the command in its own process group, which is
+// killed when the test ends.
+func startProcess(t *testing.T, name string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) })
+	return cmd
+}
+
+// expectSignaled waits for the command to be terminated by the signal.
+func expectSignaled(t *testing.T, cmd *exec.Cmd, sig syscall.Signal) {
+	t.Helper()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("process exited with %v, want %v", err, sig)
+		}
+		if ws := exitErr.Sys().(syscall.WaitStatus); !ws.Signaled() || ws.Signal() != sig {
+			t.Fatalf("process exited with %v, want %v", err, sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("process did not receive %v", sig)
+	}
+}
+
+// waitForProcess waits until the processes have started with their name.
+func waitForProcess(t *testing.T, name string, n int) []int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pids, _ := findProcesses(name)
+		if len(pids) == n || time.Now().After(deadline) {
+			return pids
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// countWorkers returns the number of children of the process that have
+// the given name.
+func countWorkers(parent int, name string) int {
+	entries, _ := ioutil.ReadDir("/proc")
+	workers := 0
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			if ppid, ok := matchProcess(pid, name); ok && ppid == parent {
+				workers++
+			}
+		}
+	}
+	return workers
+}
+
+func TestNotifySignalPidfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "sleep.pid")
+
+	cmd := startProcess(t, "sleep", "10")
+	ioutil.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+
+	tmpl := Template{Source: "app.tmpl", NotifySignal: "TERM", NotifyPidfile: pidfile}
+	if err := notifySignal(log.WithField("template", "app.tmpl"), tmpl); err != nil {
+		t.Fatal(err)
+	}
+	expectSignaled(t, cmd, syscall.SIGTERM)
+
+	// the process is gone now
+	err = notifySignal(log.WithField("template", "app.tmpl"), tmpl)
+	if e, ok := err.(*notifySignalError); !ok || e.Err != errStalePidfile || e.Signal != syscall.SIGTERM {
+		t.Errorf("got error %#v, want stale pidfile error", err)
+	}
+}
+
+func TestNotifySignalProcess(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc is not available")
+	}
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// names in /proc/<pid>/stat may contain spaces and parentheses
+	name := fmt.Sprintf("rg (%d) x", os.Getpid()%1000)
+	cmd := startProcess(t, copyShell(t, dir, name), "-c", "sleep 10; :")
+	if pids := waitForProcess(t, name, 1); len(pids) != 1 || pids[0] != cmd.Process.Pid {
+		t.Fatalf("found processes %v, want %d", pids, cmd.Process.Pid)
+	}
+
+	tmpl := Template{Source: "app.tmpl", NotifySignal: "SIGUSR1", NotifyProcess: name}
+	if err := notifySignal(log.WithField("template", "app.tmpl"), tmpl); err != nil {
+		t.Fatal(err)
+	}
+	expectSignaled(t, cmd, syscall.SIGUSR1)
+
+	tmpl.NotifyProcess = "rg-no-such-process"
+	err = notifySignal(log.WithField("template", "app.tmpl"), tmpl)
+	if e, ok := err.(*notifySignalError); !ok || e.Err != errNoProcess {
+		t.Errorf("got error %#v, want no matching process error", err)
+	}
+}
+
+func TestNotifySignalParentOnly(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc is not available")
+	}
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a master process with two workers of the same name
+	name := fmt.Sprintf("rg-master-%d", os.Getpid()%1000)
+	shell := copyShell(t, dir, name)
+	worker := "'" + shell + "' -c 'sleep 10; :' &"
+	cmd := startProcess(t, shell, "-c", worker+worker+" sleep 10; :")
+	for deadline := time.Now().Add(5 * time.Second); countWorkers(cmd.Process.Pid, name) < 2; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("workers did not start")
+		}
+	}
+
+	if pids, err := findProcesses(name); err != nil || len(pids) != 1 || pids[0] != cmd.Process.Pid {
+		t.Fatalf("found processes %v, %v, want only the master %d", pids, err, cmd.Process.Pid)
+	}
+
+	tmpl := Template{Source: "app.tmpl", NotifySignal: "TERM", NotifyProcess: name}
+	if err := notifySignal(log.WithField("template", "app.tmpl"), tmpl); err != nil {
+		t.Fatal(err)
+	}
+	expectSignaled(t, cmd, syscall.SIGTERM)
+}
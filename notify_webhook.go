@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultNotifyTimeout = 10 * time.Second
+	defaultNotifyRetries = 3
+)
+
+// webhookPolicy configures the delays between retries of failed webhook
+// notifications.
+var webhookPolicy = retryPolicy{
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Jitter:       0.2,
+}
+
+// webhookPayload describes the update of a destination. It is sent as
+// JSON unless the template has a notify body.
+type webhookPayload struct {
+	Source  string `json:"source"`
+	Dest    string `json:"dest"`
+	Version string `json:"version"`
+	Hash    string `json:"hash"` // MD5 checksum of the content
+}
+
+// webhookError is returned when the notify URL responds with an error.
+type webhookError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("Error %d: %s", e.StatusCode, e.Body)
+}
+
+// retryable returns true for responses that may succeed when retried.
+func (e *webhookError) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// notifyURL sends the webhook notification of the template. Failed
+// requests are retried with backoff up to notify-retries times.
+func notifyURL(logger *log.Entry, client *http.Client, policy retryPolicy, t Template, payload webhookPayload) error {
+	retries := defaultNotifyRetries
+	if t.NotifyRetries != nil {
+		retries = *t.NotifyRetries
+	}
+
+	body, err := webhookBody(t, payload)
+	if err != nil {
+		return err
+	}
+
+	method := strings.ToUpper(t.NotifyMethod)
+	if method == "" {
+		method = "POST"
+	}
+
+	logger.Infof("Sending notification to %s %s", method, t.NotifyURL)
+	b := newBackoff(policy)
+	for attempt := 0; ; attempt++ {
+		output, err := sendWebhook(client, method, t, body)
+		if err == nil {
+			if t.NotifyOutput {
+				logCmdOutput(logger, t.NotifyURL, output)
+			}
+			logger.Debugf("Notify URL response: %q", string(output))
+			return nil
+		}
+
+		logCmdOutput(logger, t.NotifyURL, output)
+		if webhookErr, ok := err.(*webhookError); ok && !webhookErr.retryable() {
+			return err
+		}
+		delay, ok := b.Next()
+		if !ok || attempt >= retries {
+			return err
+		}
+		logger.Warnf("Notification to %s failed: %v. Retrying in %v", t.NotifyURL, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+func sendWebhook(client *http.Client, method string, t Template, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, t.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if t.NotifyBody == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range t.NotifyHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	output, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return output, &webhookError{resp.StatusCode, strings.TrimSpace(string(output))}
+	}
+
+	return output, nil
+}
+
+// webhookBody renders the notify body template with the payload, or
+// encodes the payload as JSON if the template has no notify body.
+func webhookBody(t Template, payload webhookPayload) ([]byte, error) {
+	if t.NotifyBody == "" {
+		return json.Marshal(payload)
+	}
+
+	tmpl, err := template.New("notify-body").Parse(t.NotifyBody)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse notify body: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, payload); err != nil {
+		return nil, fmt.Errorf("Could not render notify body: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func validateNotifyURL(t Template) error {
+	if t.NotifyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(t.NotifyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid notify URL '%s'", t.NotifyURL)
+	}
+	if t.NotifyBody != "" {
+		if _, err := template.New("notify-body").Parse(t.NotifyBody); err != nil {
+			return fmt.Errorf("Could not parse notify body: %v", err)
+		}
+	}
+	if (t.NotifyRetries != nil && *t.NotifyRetries < 0) || t.NotifyTimeout < 0 {
+		return fmt.Errorf("notify-retries and notify-timeout must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// webhookServer responds to successive requests with the given statuses,
+// repeating the last one, and records the requests it received.
+type webhookServer struct {
+	mu       sync.Mutex
+	statuses []int
+	delay    time.Duration
+	requests []*http.Request
+	bodies   []string
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	s.mu.Lock()
+	n := len(s.requests)
+	s.requests = append(s.requests, req)
+	s.bodies = append(s.bodies, string(body))
+	status := s.statuses[len(s.statuses)-1]
+	if n < len(s.statuses) {
+		status = s.statuses[n]
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(s.delay):
+	case <-req.Context().Done():
+		return
+	}
+	w.WriteHeader(status)
+	w.Write([]byte("response"))
+}
+
+func (s *webhookServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+var testWebhookPolicy = retryPolicy{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func testPayload() webhookPayload {
+	return webhookPayload{Source: "app.tmpl", Dest: "/etc/app.conf", Version: "42", Hash: "abc"}
+}
+
+func TestNotifyURLRetries(t *testing.T) {
+	retries := 2
+	tests := []struct {
+		name     string
+		statuses []int
+		err      bool
+		requests int
+	}{
+		{"success", []int{http.StatusOK}, false, 1},
+		{"server error", []int{http.StatusServiceUnavailable, http.StatusOK}, false, 2},
+		{"too many requests", []int{http.StatusTooManyRequests, http.StatusNoContent}, false, 2},
+		{"client error", []int{http.StatusBadRequest}, true, 1},
+		{"retries exhausted", []int{http.StatusInternalServerError}, true, retries + 1},
+	}
+
+	logger := log.WithField("template", "app.tmpl")
+	for _, test := range tests {
+		hook := &webhookServer{statuses: test.statuses}
+		server := httptest.NewServer(hook)
+		tmpl := Template{Source: "app.tmpl", NotifyURL: server.URL, NotifyRetries: &retries}
+
+		err := notifyURL(logger, server.Client(), testWebhookPolicy, tmpl, testPayload())
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error: %t", test.name, err, test.err)
+		}
+		if n := hook.count(); n != test.requests {
+			t.Errorf("%s: sent %d requests, want %d", test.name, n, test.requests)
+		}
+		if webhookErr, ok := err.(*webhookError); test.err && (!ok || webhookErr.Body != "response") {
+			t.Errorf("%s: got error %#v, want webhook error with response body", test.name, err)
+		}
+		server.Close()
+	}
+}
+
+func TestNotifyURLRequest(t *testing.T) {
+	hook := &webhookServer{statuses: []int{http.StatusOK}}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	logger := log.WithField("template", "app.tmpl")
+
+	// the payload is sent as JSON by default
+	tmpl := Template{Source: "app.tmpl", NotifyURL: server.URL}
+	if err := notifyURL(logger, server.Client(), testWebhookPolicy, tmpl, testPayload()); err != nil {
+		t.Fatal(err)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(hook.bodies[0]), &payload); err != nil || payload != testPayload() {
+		t.Errorf("got payload %s, want %+v", hook.bodies[0], testPayload())
+	}
+	if req := hook.requests[0]; req.Method != "POST" || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s request with content type %q, want JSON POST", req.Method, req.Header.Get("Content-Type"))
+	}
+
+	tmpl = Template{
+		Source:        "app.tmpl",
+		NotifyURL:     server.URL,
+		NotifyMethod:  "put",
+		NotifyHeaders: map[string]string{"Authorization": "Bearer secret", "Content-Type": "text/plain"},
+		NotifyBody:    "{{.Dest}} changed to {{.Hash}} in version {{.Version}}",
+	}
+	if err := notifyURL(logger, server.Client(), testWebhookPolicy, tmpl, testPayload()); err != nil {
+		t.Fatal(err)
+	}
+	req := hook.requests[1]
+	if req.Method != "PUT" {
+		t.Errorf("got method %s, want PUT", req.Method)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("got Authorization header %q", got)
+	}
+	if got := req.Header.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("got Content-Type header %q, want text/plain", got)
+	}
+	if want := "/etc/app.conf changed to abc in version 42"; hook.bodies[1] != want {
+		t.Errorf("got body %q, want %q", hook.bodies[1], want)
+	}
+}
+
+func TestNotifyURLTimeout(t *testing.T) {
+	hook := &webhookServer{statuses: []int{http.StatusOK}, delay: time.Second}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	retries := 1
+	tmpl := Template{Source: "app.tmpl", NotifyURL: server.URL, NotifyRetries: &retries}
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	if err := notifyURL(log.WithField("template", "app.tmpl"), client, testWebhookPolicy, tmpl, testPayload()); err == nil {
+		t.Error("notification to an unresponsive server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("notification took %v, want two timeouts", elapsed)
+	}
+	// timeouts are retried
+	if n := hook.count(); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestValidateNotifyURL(t *testing.T) {
+	negative := -1
+	tests := []struct {
+		tmpl Template
+		err  bool
+	}{
+		{Template{}, false},
+		{Template{NotifyURL: "http://localhost:8080/reload"}, false},
+		{Template{NotifyURL: "localhost:8080"}, true},
+		{Template{NotifyURL: "ftp://localhost/reload"}, true},
+		{Template{NotifyURL: "http://localhost", NotifyBody: "{{.Dest"}, true},
+		{Template{NotifyURL: "http://localhost", NotifyRetries: &negative}, true},
+	}
+
+	for _, test := range tests {
+		if err := validateNotifyURL(test.tmpl); (err != nil) != test.err {
+			t.Errorf("%+v: got error %v, want error: %t", test.tmpl, err, test.err)
+		}
+	}
+}
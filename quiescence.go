@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clock provides the current time. It can be replaced to control time in
+// tests.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// waitWindow is the minimum and maximum time to wait for the Metadata to
+// become stable before rendering. It is decoded from "min:max", e.g.
+// "5s:30s". If only the minimum is given, the maximum is four times the
+// minimum.
+type waitWindow struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (w *waitWindow) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(string(text), ":", 2)
+	min, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return fmt.Errorf("Invalid wait '%s': %v", text, err)
+	}
+	max := 4 * min
+	if len(parts) == 2 {
+		if max, err = time.ParseDuration(parts[1]); err != nil {
+			return fmt.Errorf("Invalid wait '%s': %v", text, err)
+		}
+	}
+	if min < 0 || max < min {
+		return fmt.Errorf("Invalid wait '%s': the maximum must not be lower than the minimum", text)
+	}
+	w.Min, w.Max = min, max
+	return nil
+}
+
+func (w *waitWindow) String() string {
+	return fmt.Sprintf("%v:%v", w.Min, w.Max)
+}
+
+func (w *waitWindow) Set(v string) error {
+	return w.UnmarshalText([]byte(v))
+}
+
+// quiescence delays an action until no changes have been observed for
+// the minimum wait time, but no longer than the maximum wait time since
+// the first change.
+type quiescence struct {
+	window waitWindow
+	clock  clock
+	first  time.Time
+	last   time.Time
+}
+
+func newQuiescence(window waitWindow, c clock) *quiescence {
+	return &quiescence{window: window, clock: c}
+}
+
+// Change records a change.
+func (q *quiescence) Change() {
+	if q.window.Max == 0 {
+		return
+	}
+	now := q.clock.Now()
+	if q.first.IsZero() {
+		q.first = now
+	}
+	q.last = now
+}
+
+// Pending returns the time left until the action may happen. It returns
+// false if the action is not delayed.
+func (q *quiescence) Pending() (time.Duration, bool) {
+	if q.first.IsZero() {
+		return 0, false
+	}
+
+	deadline := q.last.Add(q.window.Min)
+	if max := q.first.Add(q.window.Max); max.Before(deadline) {
+		deadline = max
+	}
+
+	left := deadline.Sub(q.clock.Now())
+	if left <= 0 {
+		return 0, false
+	}
+	return left, true
+}
+
+// Reset forgets all changes, e.g. after the action happened.
+func (q *quiescence) Reset() {
+	q.first = time.Time{}
+	q.last = time.Time{}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func expectPending(t *testing.T, q *quiescence, want time.Duration) {
+	t.Helper()
+	left, pending := q.Pending()
+	if want == 0 && pending {
+		t.Errorf("pending for %v, want not pending", left)
+	}
+	if want != 0 && (!pending || left != want) {
+		t.Errorf("pending for %v (%t), want %v", left, pending, want)
+	}
+}
+
+func TestQuiescenceMinimum(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q := newQuiescence(waitWindow{Min: 5 * time.Second, Max: 30 * time.Second}, clock)
+	expectPending(t, q, 0)
+
+	q.Change()
+	expectPending(t, q, 5*time.Second)
+
+	clock.Advance(4 * time.Second)
+	expectPending(t, q, time.Second)
+
+	// another change restarts the minimum wait
+	q.Change()
+	expectPending(t, q, 5*time.Second)
+
+	clock.Advance(5 * time.Second)
+	expectPending(t, q, 0)
+}
+
+func TestQuiescenceMaximum(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q := newQuiescence(waitWindow{Min: 5 * time.Second, Max: 12 * time.Second}, clock)
+
+	// changes every 4 seconds never leave the minimum wait
+	q.Change()
+	clock.Advance(4 * time.Second)
+	q.Change()
+	clock.Advance(4 * time.Second)
+	q.Change()
+	expectPending(t, q, 4*time.Second)
+
+	clock.Advance(3 * time.Second)
+	q.Change()
+	expectPending(t, q, time.Second)
+
+	clock.Advance(time.Second)
+	expectPending(t, q, 0)
+
+	q.Reset()
+	expectPending(t, q, 0)
+	q.Change()
+	expectPending(t, q, 5*time.Second)
+}
+
+func TestQuiescenceDisabled(t *testing.T) {
+	q := newQuiescence(waitWindow{}, &fakeClock{now: time.Unix(1000, 0)})
+	q.Change()
+	expectPending(t, q, 0)
+}
+
+func TestWaitWindow(t *testing.T) {
+	tests := []struct {
+		value string
+		want  waitWindow
+		err   bool
+	}{
+		{value: "5s:30s", want: waitWindow{5 * time.Second, 30 * time.Second}},
+		{value: "5s", want: waitWindow{5 * time.Second, 20 * time.Second}},
+		{value: "0s", want: waitWindow{}},
+		{value: "30s:5s", err: true},
+		{value: "-1s:5s", err: true},
+		{value: "5", err: true},
+		{value: "5s:x", err: true},
+	}
+
+	for _, test := range tests {
+		var w waitWindow
+		err := w.Set(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %v, want error", test.value, w)
+			}
+			continue
+		}
+		if err != nil || w != test.want {
+			t.Errorf("%s: got %v, %v, want %v", test.value, w, err, test.want)
+		}
+	}
+}
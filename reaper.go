@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// reapLock is held for reading while os/exec starts and waits for a
+// command, and for writing while orphaned processes are reaped, so that
+// the reaper cannot take the exit status of the command.
+var reapLock sync.RWMutex
+
+// commandOutput runs the command like cmd.CombinedOutput.
+func commandOutput(cmd *exec.Cmd) ([]byte, error) {
+	reapLock.RLock()
+	defer reapLock.RUnlock()
+	return cmd.CombinedOutput()
+}
+
+// reaper reaps orphaned processes that have been reparented to rancher-gen,
+// because it runs as PID 1 or as child subreaper. The exit status of
+// watched processes, e.g. the command run in exec mode, is delivered to
+// their watchers.
+type reaper struct {
+	mu      sync.Mutex
+	watched map[int]chan syscall.WaitStatus
+	sigs    chan os.Signal
+	done    chan struct{}
+}
+
+// startReaper starts reaping orphaned processes. Unless it runs as PID 1,
+// rancher-gen becomes the child subreaper of its descendants.
+func startReaper() (*reaper, error) {
+	if os.Getpid() != 1 {
+		if err := setSubreaper(); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &reaper{
+		watched: make(map[int]chan syscall.WaitStatus),
+		sigs:    make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	signal.Notify(r.sigs, syscall.SIGCHLD)
+	go func() {
+		for {
+			select {
+			case <-r.sigs:
+				r.reap()
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+// Stop stops reaping orphaned processes.
+func (r *reaper) Stop() {
+	signal.Stop(r.sigs)
+	close(r.done)
+}
+
+// Watch returns a channel that receives the exit status of the process
+// once it has been reaped. It must be called while reapLock is held, before
+// the process can be reaped.
+func (r *reaper) Watch(pid int) <-chan syscall.WaitStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exited := make(chan syscall.WaitStatus, 1)
+	r.watched[pid] = exited
+	return exited
+}
+
+// reap waits for all exited child processes.
+func (r *reaper) reap() {
+	reapLock.Lock()
+	defer reapLock.Unlock()
+
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+
+		r.mu.Lock()
+		exited, ok := r.watched[pid]
+		delete(r.watched, pid)
+		r.mu.Unlock()
+		if ok {
+			exited <- ws
+			continue
+		}
+		log.Debugf("Reaped orphaned process %d", pid)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// prSetChildSubreaper is the prctl option to become the child subreaper.
+const prSetChildSubreaper = 36
+
+// setSubreaper makes orphaned descendants of rancher-gen its children.
+func setSubreaper() error {
+	return unix.Prctl(prSetChildSubreaper, 1, 0, 0, 0)
+}
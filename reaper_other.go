@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// setSubreaper is only implemented on Linux.
+func setSubreaper() error {
+	return fmt.Errorf("Becoming the child subreaper is not supported on %s", runtime.GOOS)
+}
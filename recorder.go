@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const recordingTimeFormat = "20060102T150405.000Z"
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// recorder saves the Metadata snapshot of every processed version to a
+// directory, so that rendering can later be replayed against it.
+type recorder struct {
+	dir    string
+	keep   int
+	maxAge time.Duration
+}
+
+// recording is a Metadata snapshot saved by the recorder.
+type recording struct {
+	Path    string
+	Version string
+	Time    time.Time
+}
+
+// Record writes the snapshot to a file named by timestamp and version
+// and then removes recordings exceeding the retention limits. The file is
+// named by the unquoted version, as it is given to the replay command.
+func (rec *recorder) Record(snap *snapshot) error {
+	if err := os.MkdirAll(rec.dir, 0755); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s_%s.json", time.Now().UTC().Format(recordingTimeFormat),
+		recordingName(snap.label()))
+	path := filepath.Join(rec.dir, name)
+
+	tmp := filepath.Join(rec.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	log.Debugf("Recorded Metadata version %s to %s", snap.label(), path)
+
+	return rec.prune()
+}
+
+// prune removes the oldest recordings exceeding the maximum count or age.
+func (rec *recorder) prune() error {
+	recordings, err := listRecordings(rec.dir)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range recordings {
+		tooMany := rec.keep > 0 && i < len(recordings)-rec.keep
+		tooOld := rec.maxAge > 0 && time.Since(r.Time) > rec.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		log.Debugf("Removing recording %s", r.Path)
+		if err := os.Remove(r.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listRecordings returns the recordings found in dir, oldest first.
+func listRecordings(dir string) ([]recording, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := make([]recording, 0)
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(name, ".json"), "_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		t, err := time.Parse(recordingTimeFormat, parts[0])
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, recording{
+			Path:    filepath.Join(dir, name),
+			Version: parts[1],
+			Time:    t,
+		})
+	}
+
+	sort.Sort(byRecordingTime(recordings))
+	return recordings, nil
+}
+
+// findRecording returns the most recent recording of the given version.
+// The version may also be given as the file name of the recording.
+func findRecording(dir, version string) (recording, error) {
+	recordings, err := listRecordings(dir)
+	if err != nil {
+		return recording{}, err
+	}
+
+	safeVersion := recordingName(version)
+	for i := len(recordings) - 1; i >= 0; i-- {
+		r := recordings[i]
+		if r.Version == safeVersion || filepath.Base(r.Path) == version {
+			return r, nil
+		}
+	}
+
+	return recording{}, fmt.Errorf("No recording of version %s found in %s", version, dir)
+}
+
+// recordingName returns the version as used in the file name of a
+// recording.
+func recordingName(version string) string {
+	return unsafeFileChars.ReplaceAllString(unquoteVersion(version), "_")
+}
+
+type byRecordingTime []recording
+
+func (r byRecordingTime) Len() int           { return len(r) }
+func (r byRecordingTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRecordingTime) Less(i, j int) bool { return r[i].Time.Before(r[j].Time) }
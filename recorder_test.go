@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndFindRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := &recorder{dir: dir}
+	for _, version := range []string{"6", `"7"`, "8/a"} {
+		snap := &snapshot{Version: version, Services: json.RawMessage("[]")}
+		if err := rec.Record(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		version string
+		name    string // suffix of the recording found
+		err     bool
+	}{
+		{version: "7", name: "_7.json"},
+		{version: `"7"`, name: "_7.json"},
+		{version: "8/a", name: "_8_a.json"},
+		{version: "9", err: true},
+	}
+
+	for _, test := range tests {
+		r, err := findRecording(dir, test.version)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: found recording %s, want error", test.version, r.Path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.version, err)
+			continue
+		}
+		if name := filepath.Base(r.Path); !strings.HasSuffix(name, test.name) {
+			t.Errorf("%s: found recording %s, want name ending in %s", test.version, name, test.name)
+		}
+
+		// a recording can also be found by its file name
+		if byName, err := findRecording(dir, filepath.Base(r.Path)); err != nil || byName.Path != r.Path {
+			t.Errorf("%s: got %v, %v by file name, want %s", test.version, byName, err, r.Path)
+		}
+	}
+}
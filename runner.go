@@ -2,17 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
@@ -21,91 +26,594 @@ import (
 	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
-var (
-	MetadataURL = "http://rancher-metadata"
-)
-
 type runner struct {
 	Config  *Config
 	Client  metadata.Client
 	Version string
 
-	quitChan chan os.Signal
+	ctx           *TemplateContext
+	activeCtx     *TemplateContext
+	templates     []*templateState
+	fetcher       *snapshotFetcher
+	recorder      *recorder
+	status        *status
+	sourceWatcher *fileWatcher
+	destWatcher   *fileWatcher
+	child         *child
+	quitChan      chan os.Signal
+	hupChan       chan os.Signal
+	watchFallback atomic.Bool // the Metadata API does not support watching
 }
 
 func NewRunner(conf *Config) (*runner, error) {
-	u, _ := url.Parse(MetadataURL)
-	u.Path = path.Join(u.Path, conf.MetadataVersion)
+	st := &status{degradedAfter: conf.DegradedAfter}
+
+	// SIGHUP and SIGUSR1 terminate the process by default, so they are
+	// handled before waiting for the Metadata API. A reload requested
+	// while waiting is performed once the runner has started.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	statusChan := make(chan os.Signal, 1)
+	signal.Notify(statusChan, syscall.SIGUSR1)
+	go func() {
+		for range statusChan {
+			st.logStatus()
+		}
+	}()
 
-	log.Infof("Initializing Rancher Metadata client (version %s)", conf.MetadataVersion)
+	// The endpoints are served while waiting for the Metadata API.
+	if conf.Listen != "" {
+		if err := serveHTTP(conf.Listen, st); err != nil {
+			return nil, err
+		}
+	}
 
-	client, err := metadata.NewClientAndWait(u.String())
+	client, err := newMetadataClient(conf)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to initialize Rancher Metadata client: %v", err)
+		return nil, err
 	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	return &runner{
-		Config:   conf,
-		Client:   client,
-		Version:  "init",
-		quitChan: c,
-	}, nil
+	r := &runner{
+		Config:    conf,
+		Client:    client,
+		Version:   "init",
+		templates: newTemplateStates(conf),
+		fetcher:   &snapshotFetcher{client: client},
+		status:    st,
+		quitChan:  c,
+		hupChan:   hup,
+	}
+
+	r.updateTemplateStatus()
+
+	if conf.RecordDir != "" {
+		log.Infof("Recording Metadata versions to %s", conf.RecordDir)
+		r.recorder = &recorder{
+			dir:    conf.RecordDir,
+			keep:   conf.RecordKeep,
+			maxAge: time.Duration(conf.RecordMaxAge),
+		}
+	}
+
+	return r, nil
+}
+
+func newMetadataClient(conf *Config) (metadata.Client, error) {
+	if conf.MetadataFile != "" {
+		log.Infof("Reading Rancher Metadata from file %s", conf.MetadataFile)
+		client := newFileClient(conf.MetadataFile)
+		if _, err := client.GetVersion(); err != nil {
+			return nil, fmt.Errorf("Failed to read Metadata file: %v", err)
+		}
+		return client, nil
+	}
+
+	log.Infof("Initializing Rancher Metadata client (version %s)", conf.MetadataVersion)
+
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitForMetadata(client, conf.retryPolicy()); err != nil {
+		return nil, fmt.Errorf("Failed to initialize Rancher Metadata client: %v", err)
+	}
+
+	return client, nil
 }
 
 func (r *runner) Run() error {
 	if r.Config.OneTime {
 		log.Info("Processing all templates once.")
-		return r.poll()
+		var tmplErr error
+		err := retry(r.Config.retryPolicy(), func() error {
+			err := r.poll()
+			if _, ok := err.(metadataError); ok {
+				r.status.MetadataFailure(err)
+				return err
+			}
+			tmplErr = err
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tmplErr
+	}
+
+	if r.Config.Watch {
+		log.Infof("Watching Metadata for changes with %d second timeout", r.Config.WatchTimeout)
+	} else {
+		log.Infof("Polling Metadata with %d second interval", r.Config.Interval)
+	}
+
+	// Failures are retried until Metadata is available again.
+	policy := r.Config.retryPolicy()
+	policy.MaxElapsed = 0
+	retryBackoff := newBackoff(policy)
+
+	r.startWatchers()
+	defer r.stopWatchers()
+
+	if r.Config.Exec != "" {
+		r.child = newChild(r.Config)
+	}
+
+	// Orphaned processes of the command are reaped, as are those of any
+	// command when running as PID 1 of a container.
+	if r.Config.Exec != "" || os.Getpid() == 1 {
+		reaper, err := startReaper()
+		if err != nil {
+			log.Warnf("Orphaned processes are not reaped: %v", err)
+		} else {
+			defer reaper.Stop()
+			if r.child != nil {
+				r.child.reaper = reaper
+			}
+		}
 	}
 
-	log.Info("Polling Metadata with %d second interval", r.Config.Interval)
 	ticker := time.NewTicker(time.Duration(r.Config.Interval) * time.Second)
 	defer ticker.Stop()
 	for {
-		if err := r.poll(); err != nil {
-			log.Error(err)
+		var next <-chan struct{}
+		cancel := make(chan struct{})
+		err := r.poll()
+		if _, ok := err.(metadataError); ok {
+			r.status.MetadataFailure(err)
+			delay, _ := retryBackoff.Next()
+			log.Debugf("Retrying in %v", delay)
+			next = after(delay)
+		} else {
+			// template failures have already been logged
+			retryBackoff.Reset()
+			next = r.wait(ticker.C, cancel)
+		}
+
+		if r.Config.RepairDrift {
+			r.repairDrift(r.templates)
+		}
+
+		// In exec mode the command is started once all templates have
+		// been processed.
+		if r.child != nil && !r.child.Started() && r.allApplied() {
+			if err := r.child.Start(); err != nil {
+				return err
+			}
 		}
 
+		waiting := r.waitingTemplates()
+	wait:
+		for {
+			select {
+			case <-next:
+				break wait
+			case changed := <-r.sourceWatcher.Changes():
+				r.sourcesChanged(changed)
+				waiting = r.waitingTemplates()
+			case changed := <-r.destWatcher.Changes():
+				r.repairDrift(r.templatesAt(changed))
+			case <-waiting:
+				r.processTemplates()
+				waiting = r.waitingTemplates()
+			case <-r.hupChan:
+				if err := r.reload(); err != nil {
+					log.Errorf("Rejected configuration reload, keeping the current configuration: %v", err)
+					continue
+				}
+				ticker.Reset(time.Duration(r.Config.Interval) * time.Second)
+				// re-render all templates right away
+				break wait
+			case <-r.child.Exited():
+				return r.childExited()
+			case signal := <-r.quitChan:
+				log.Info("Exit requested by signal: ", signal)
+				if r.child.Running() {
+					return r.stopChild(signal)
+				}
+				return nil
+			}
+		}
+		close(cancel)
+	}
+}
+
+// reloadChild reloads the command run in exec mode after destinations
+// have been updated.
+func (r *runner) reloadChild() {
+	if !r.child.Running() {
+		return
+	}
+	// A failed restart is reported once the runner notices the exit.
+	if err := r.child.Reload(); err != nil && r.child.RestartErr() == nil {
+		log.Errorf("Failed to reload '%s': %v", r.Config.Exec, err)
+	}
+}
+
+// repairDrift restores the destinations of the templates that have
+// drifted and reloads the command run in exec mode if any was restored.
+func (r *runner) repairDrift(states []*templateState) {
+	if restoreDrifted(states, r.ctx) {
+		r.reloadChild()
+	}
+}
+
+// stopChild forwards the signal to the command run in exec mode and waits
+// for it to exit. Further exit signals are forwarded as well.
+func (r *runner) stopChild(signal os.Signal) error {
+	r.child.Signal(signal)
+	for {
 		select {
-		case <-ticker.C:
+		case <-r.child.Exited():
+			return r.childExited()
 		case signal := <-r.quitChan:
-			log.Info("Exit requested by signal: ", signal)
-			return nil
+			r.child.Signal(signal)
+		}
+	}
+}
+
+// childExited returns the exit status of the command run in exec mode.
+func (r *runner) childExited() error {
+	if err := r.child.RestartErr(); err != nil {
+		return fmt.Errorf("Failed to restart '%s': %v", r.Config.Exec, err)
+	}
+	code := r.child.ExitCode()
+	log.Infof("'%s' exited with status %d", r.Config.Exec, code)
+	if code != 0 {
+		return exitError{code}
+	}
+	return nil
+}
+
+// allApplied returns true if every template has been processed
+// successfully at least once.
+func (r *runner) allApplied() bool {
+	for _, state := range r.templates {
+		if !state.Applied() {
+			return false
+		}
+	}
+	return true
+}
+
+// reload reads the configuration again and replaces the templates, the
+// polling interval, the wait window and the log level. All templates are
+// processed again by the next poll. If the configuration is invalid, the
+// current one is kept.
+func (r *runner) reload() error {
+	if len(configFile) == 0 {
+		return fmt.Errorf("No config file to reload")
+	}
+
+	log.Infof("Reloading config file %s", configFile)
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	newConf := *r.Config
+	newConf.Templates = conf.Templates
+	newConf.Interval = conf.Interval
+	newConf.LogLevel = conf.LogLevel
+	newConf.Wait = conf.Wait
+	r.Config = &newConf
+
+	lvl, _ := log.ParseLevel(newConf.LogLevel)
+	log.SetLevel(lvl)
+
+	r.stopWatchers()
+	r.templates = newTemplateStates(&newConf)
+	r.updateTemplateStatus()
+	r.startWatchers()
+
+	log.Infof("Configuration reloaded with %d templates", len(newConf.Templates))
+	return nil
+}
+
+// startWatchers starts watching the source files of the templates and,
+// if drift is repaired, their destinations.
+func (r *runner) startWatchers() {
+	watcher, err := newSourceWatcher(r.Config.Templates)
+	if err != nil {
+		log.Warnf("Template sources are not watched for changes: %v", err)
+	} else {
+		r.sourceWatcher = watcher
+	}
+
+	if !r.Config.RepairDrift {
+		return
+	}
+	watcher, err = newDestinationWatcher(r.Config.Templates)
+	if err != nil {
+		log.Warnf("Destinations are only checked for drift on every poll: %v", err)
+	} else {
+		r.destWatcher = watcher
+	}
+}
+
+func (r *runner) stopWatchers() {
+	if r.sourceWatcher != nil {
+		r.sourceWatcher.Close()
+		r.sourceWatcher = nil
+	}
+	if r.destWatcher != nil {
+		r.destWatcher.Close()
+		r.destWatcher = nil
+	}
+}
+
+// templatesAt returns the states of the templates with the given indexes.
+func (r *runner) templatesAt(indexes []int) []*templateState {
+	states := make([]*templateState, 0, len(indexes))
+	for _, i := range indexes {
+		states = append(states, r.templates[i])
+	}
+	return states
+}
+
+// waitingTemplates returns a channel that is closed when the first wait
+// window of a template with pending changes ends. It returns nil if no
+// template is waiting.
+func (r *runner) waitingTemplates() <-chan struct{} {
+	var next time.Duration
+	waiting := false
+	for _, state := range r.templates {
+		if left, ok := state.Waiting(); ok && (!waiting || left < next) {
+			next = left
+			waiting = true
 		}
 	}
+	if !waiting {
+		return nil
+	}
+	log.Debugf("Waiting %v for Metadata to become stable", next)
+	return after(next)
+}
+
+// sourcesChanged re-renders the templates with the given indexes because
+// their source files have changed.
+func (r *runner) sourcesChanged(indexes []int) {
+	for _, i := range indexes {
+		log.Infof("Template %s has changed", r.templates[i].Template.Source)
+		r.templates[i].Invalidate()
+	}
+
+	// Without Metadata the templates are processed by the next poll.
+	if r.ctx != nil {
+		r.processTemplates()
+	}
+}
+
+// wait returns a channel that is closed when the next poll is due.
+// In watch mode this happens as soon as the Metadata version changes
+// or the watch timeout expires. If the Metadata API does not support
+// watching, it falls back to waiting for the next tick from then on.
+// Closing cancel stops waiting and aborts a pending watch request.
+func (r *runner) wait(tick <-chan time.Time, cancel <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	// The configuration may be reloaded while waiting.
+	version := r.Version
+	watch, watchTimeout, interval := r.Config.Watch, r.Config.WatchTimeout, r.Config.Interval
+	go func() {
+		defer close(done)
+		if watch && !r.watchFallback.Load() {
+			ctx, stop := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-cancel:
+					stop()
+				case <-ctx.Done():
+				}
+			}()
+			err := r.waitForVersionChange(ctx, version, watchTimeout)
+			canceled := ctx.Err() != nil
+			stop()
+			if err == nil || canceled {
+				return
+			}
+			if err == errWatchUnsupported {
+				log.Warnf("Metadata API does not support watching the version, falling back to polling every %d seconds", interval)
+				r.watchFallback.Store(true)
+			} else {
+				log.Debugf("Failed to watch Metadata version: %v", err)
+			}
+		}
+		select {
+		case <-tick:
+		case <-cancel:
+		}
+	}()
+	return done
+}
+
+// after returns a channel that is closed after the given delay.
+func after(d time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	time.AfterFunc(d, func() { close(done) })
+	return done
+}
+
+// errWatchUnsupported means that the Metadata API rejected the request to
+// watch the version or returned without waiting for a change.
+var errWatchUnsupported = errors.New("watching the Metadata version is not supported")
+
+// waitForVersionChange blocks until the Metadata version differs from
+// the given version, the watch timeout (in seconds) expires or ctx is done.
+func (r *runner) waitForVersionChange(ctx context.Context, version string, timeout int) error {
+	log.Debugf("Waiting for Metadata version to change from %s", version)
+	path := fmt.Sprintf("/version?wait=true&value=%s&maxWait=%d",
+		url.QueryEscape(version), timeout)
+
+	start := time.Now()
+	var newVersion []byte
+	var err error
+	if client, ok := r.Client.(contextSender); ok {
+		newVersion, err = client.SendRequestContext(ctx, path)
+	} else {
+		newVersion, err = r.Client.SendRequest(path)
+	}
+	if err != nil {
+		if e, ok := err.(*statusError); ok && e.StatusCode < 500 {
+			return errWatchUnsupported
+		}
+		return err
+	}
+
+	// A server that ignores the wait parameter returns the current
+	// version right away, which would turn watching into busy polling.
+	if unquoteVersion(string(newVersion)) == version && timeout > 1 &&
+		time.Since(start) < time.Second {
+		return errWatchUnsupported
+	}
+
+	log.Debugf("Watch returned version %s", newVersion)
+	return nil
 }
 
 func (r *runner) poll() error {
 	log.Debug("Checking for metadata change")
+	start := time.Now()
 	newVersion, err := r.Client.GetVersion()
+	metrics.ObservePoll(time.Since(start), err)
 	if err != nil {
-		time.Sleep(time.Second * 2)
-		return fmt.Errorf("Failed to get Metadata version: %v", err)
+		return metadataError{fmt.Errorf("Failed to get Metadata version: %v", err)}
 	}
 
 	if r.Version == newVersion {
-		log.Debug("No changes in Metadata")
-		return nil
+		r.status.MetadataSuccess(r.ctx.Version)
+		if !r.templatesDue() {
+			log.Debug("No changes in Metadata")
+			return nil
+		}
+		log.Debug("Processing pending templates")
+		return r.processTemplates()
 	}
 
 	log.Debugf("Old version: %s, New Version: %s", r.Version, newVersion)
 
-	r.Version = newVersion
-	ctx, err := r.createContext()
+	log.Debug("Fetching Metadata")
+	start = time.Now()
+	snap, err := r.fetcher.Fetch(newVersion)
+	metrics.ObserveFetch(time.Since(start), err)
 	if err != nil {
-		time.Sleep(time.Second * 2)
-		return fmt.Errorf("Failed to create context from Rancher Metadata: %v", err)
+		return metadataError{fmt.Errorf("Failed to fetch Rancher Metadata: %v", err)}
 	}
 
-	tmplFuncs := newFuncMap(ctx)
-	for _, tmpl := range r.Config.Templates {
-		if err := r.processTemplate(tmplFuncs, tmpl); err != nil {
-			return err
+	if r.recorder != nil {
+		if err := r.recorder.Record(snap); err != nil {
+			log.Warnf("Failed to record Metadata version %s: %v", snap.Version, err)
+		}
+	}
+
+	ctx, err := createContext(snap)
+	if err != nil {
+		return metadataError{fmt.Errorf("Failed to create context from Rancher Metadata: %v", err)}
+	}
+
+	r.ctx = ctx
+	r.activeCtx = ctx.activeOnly()
+	r.Version = snap.Version
+	r.status.MetadataSuccess(ctx.Version)
+	metrics.SetVersion(ctx.Version)
+
+	for _, state := range r.templates {
+		state.Changed(r.Version, r.templateContext(state.Template))
+	}
+
+	return r.processTemplates()
+}
+
+// templatesDue returns true if any template needs to be processed for
+// the current Metadata version.
+func (r *runner) templatesDue() bool {
+	for _, state := range r.templates {
+		if state.Due(r.Version) {
+			return true
 		}
 	}
+	return false
+}
+
+// processTemplates processes all templates that have not yet been applied
+// for the current Metadata version.
+func (r *runner) processTemplates() error {
+	defer r.updateTemplateStatus()
+
+	due := make([]*templateState, 0, len(r.templates))
+	for _, state := range r.templates {
+		if state.Due(r.Version) {
+			due = append(due, state)
+		}
+	}
+
+	// Templates are processed by a bounded number of workers. Output to
+	// stdout is buffered and results are handled in configuration order.
+	results := make([]error, len(due))
+	renders := make([]render, len(due))
+	workers := make(chan struct{}, r.Config.Concurrency)
+	var wg sync.WaitGroup
+	for i, state := range due {
+		// acquiring a worker before starting the goroutine keeps the
+		// configuration order with a concurrency of 1
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(i int, ctx *TemplateContext, t Template, notifyPending bool) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			results[i] = r.processTemplate(ctx, t, notifyPending, &renders[i])
+		}(i, r.templateContext(state.Template), state.Template, state.NotifyPending())
+	}
+	wg.Wait()
+
+	var errs templateErrors
+	updated := false
+	for i, state := range due {
+		updated = updated || renders[i].updated
+		os.Stdout.Write(renders[i].stdout.Bytes())
+		err := results[i]
+		delay := state.Done(r.Version, &renders[i], err)
+		if err != nil {
+			if r.Config.OneTime {
+				log.Errorf("Failed to process template %s: %v", state.Template.Source, err)
+			} else {
+				log.Errorf("Failed to process template %s: %v. Retrying in %v", state.Template.Source, err, delay)
+			}
+			errs = append(errs, templateError{state.Template, err})
+		}
+	}
+
+	if updated {
+		r.reloadChild()
+	}
+
+	if len(errs) > 0 {
+		log.Warnf("Processed templates with %d failures", len(errs))
+		return errs
+	}
 
 	if r.Config.OneTime {
 		log.Info("All templates processed. Exiting.")
@@ -116,48 +624,113 @@ func (r *runner) poll() error {
 	return nil
 }
 
-func (r *runner) processTemplate(funcs template.FuncMap, t Template) error {
-	log.Debugf("Processing template %s for destination %s", t.Source, t.Dest)
+// templateContext returns the context the template is rendered with.
+func (r *runner) templateContext(t Template) *TemplateContext {
+	if r.Config.IncludeInactive || t.IncludeInactive {
+		return r.ctx
+	}
+	return r.activeCtx
+}
+
+func (r *runner) updateTemplateStatus() {
+	templates := make([]templateStatus, 0, len(r.templates))
+	for _, state := range r.templates {
+		templates = append(templates, state.Status())
+	}
+	r.status.SetTemplates(templates)
+}
+
+// render is the outcome of processing a template.
+type render struct {
+	content []byte
+	updated bool         // whether the destination has been written or notified
+	stdout  bytes.Buffer // output of templates without destination
+	deps    dependencies // Metadata lookups made by the template
+}
+
+// processTemplate renders the template and updates its destination.
+// Content of templates without destination is written to out.stdout.
+// If notifyPending is set, the notifications of a destination that is
+// up to date are sent again, as they failed after it was written.
+func (r *runner) processTemplate(ctx *TemplateContext, t Template, notifyPending bool, out *render) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveRender(t.Source, time.Since(start), len(out.content), err)
+	}()
+
+	logger := log.WithField("template", t.Source)
+	logger.Debugf("Processing template for destination %s", t.Dest)
 	if _, err := os.Stat(t.Source); os.IsNotExist(err) {
-		log.Fatalf("Template '%s' is missing", t.Source)
+		return fmt.Errorf("Template '%s' is missing", t.Source)
 	}
 
 	tmplBytes, err := ioutil.ReadFile(t.Source)
 	if err != nil {
-		log.Fatalf("Could not read template '%s': %v", t.Source, err)
+		return fmt.Errorf("Could not read template '%s': %v", t.Source, err)
 	}
 
 	name := filepath.Base(t.Source)
-	newTemplate, err := template.New(name).Funcs(funcs).Parse(string(tmplBytes))
+	newTemplate, err := template.New(name).Funcs(newFuncMap(ctx, &out.deps)).Parse(string(tmplBytes))
 	if err != nil {
-		log.Fatalf("Could not parse template '%s': %v", t.Source, err)
+		return fmt.Errorf("Could not parse template '%s': %v", t.Source, err)
+	}
+
+	for _, pattern := range t.Partials {
+		partials, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid partials pattern '%s': %v", pattern, err)
+		}
+		if len(partials) == 0 {
+			continue
+		}
+		if _, err := newTemplate.ParseFiles(partials...); err != nil {
+			return fmt.Errorf("Could not parse partials '%s': %v", pattern, err)
+		}
+	}
+
+	if usesRootData(newTemplate) {
+		logger.Debug("Template uses the root data and is rendered on every Metadata change")
+		out.deps.untracked = true
 	}
 
 	buf := new(bytes.Buffer)
-	if err := newTemplate.Execute(buf, nil); err != nil {
-		log.Fatalf("Could not render template: '%s': %v", t.Source, err)
+	if err := newTemplate.Execute(buf, ctx); err != nil {
+		return fmt.Errorf("Could not render template '%s': %v", t.Source, err)
 	}
 
 	content := buf.Bytes()
+	out.content = content
 
 	if t.Dest == "" {
-		log.Debug("No destination specified. Printing to StdOut")
-		os.Stdout.Write(content)
+		logger.Debug("No destination specified. Printing to StdOut")
+		out.stdout.Write(content)
 		return nil
 	}
 
-	log.Debug("Checking whether content has changed")
+	logger.Debug("Checking whether content has changed")
 	same, err := sameContent(content, t.Dest)
 	if err != nil {
 		return fmt.Errorf("Could not compare content for %s: %v", t.Dest, err)
 	}
 
-	if same {
-		log.Debugf("Destination %s is up to date", t.Dest)
+	if same && !notifyPending {
+		logger.Debugf("Destination %s is up to date", t.Dest)
 		return nil
 	}
 
-	log.Debug("Creating staging file")
+	if same {
+		logger.Infof("Destination %s is up to date, retrying failed notifications", t.Dest)
+	} else if err := writeDestination(logger, t, content); err != nil {
+		return err
+	}
+	out.updated = true
+	return notifyDestination(logger, t, content, ctx.Version, ctx)
+}
+
+// writeDestination checks the content with the check command and writes
+// it to the destination.
+func writeDestination(logger *log.Entry, t Template, content []byte) error {
+	logger.Debug("Creating staging file")
 	stagingFile, err := createStagingFile(content, t.Dest)
 	if err != nil {
 		return err
@@ -166,24 +739,72 @@ func (r *runner) processTemplate(funcs template.FuncMap, t Template) error {
 	defer os.Remove(stagingFile)
 
 	if t.CheckCmd != "" {
-		if err := check(t.CheckCmd, stagingFile); err != nil {
+		if err := check(logger, t.CheckCmd, stagingFile); err != nil {
+			metrics.CheckFailed(t.Source)
 			return fmt.Errorf("Check command failed: %v", err)
 		}
 	}
 
-	log.Debugf("Writing destination")
+	logger.Debugf("Writing destination")
 	if err = copyStagingToDestination(stagingFile, t.Dest); err != nil {
 		return fmt.Errorf("Could not write destination file %s: %v", t.Dest, err)
 	}
 
-	log.Info("Destination file %s has been updated", t.Dest)
+	logger.Infof("Destination file %s has been updated", t.Dest)
+	return nil
+}
 
+// notifyDestination sends the notifications of the template after its
+// destination has been updated. The content was rendered for the given
+// version, while ctx is the current Metadata used to find the containers
+// to notify.
+func notifyDestination(logger *log.Entry, t Template, content []byte, version string, ctx *TemplateContext) error {
 	if t.NotifyCmd != "" {
-		if err := notify(t.NotifyCmd, t.NotifyOutput); err != nil {
+		if err := notify(logger, t.NotifyCmd, t.NotifyOutput); err != nil {
+			metrics.NotifyFailed(t.Source)
 			return fmt.Errorf("Notify command failed: %v", err)
 		}
 	}
 
+	if t.NotifySignal != "" {
+		if err := notifySignal(logger, t); err != nil {
+			metrics.NotifyFailed(t.Source)
+			return err
+		}
+	}
+
+	if t.NotifyURL != "" {
+		timeout := time.Duration(t.NotifyTimeout)
+		if timeout == 0 {
+			timeout = defaultNotifyTimeout
+		}
+		payload := webhookPayload{
+			Source:  t.Source,
+			Dest:    t.Dest,
+			Version: version,
+			Hash:    fmt.Sprintf("%x", md5.Sum(content)),
+		}
+		if err := notifyURL(logger, &http.Client{Timeout: timeout}, webhookPolicy, t, payload); err != nil {
+			metrics.NotifyFailed(t.Source)
+			return fmt.Errorf("Notify URL failed: %v", err)
+		}
+	}
+
+	if t.NotifyDocker != "" {
+		timeout := time.Duration(t.NotifyTimeout)
+		if timeout == 0 {
+			timeout = defaultDockerTimeout
+		}
+		socket := t.NotifyDockerSocket
+		if socket == "" {
+			socket = defaultDockerSocket
+		}
+		if err := notifyDocker(logger, newDockerClient(socket, timeout), t, ctx); err != nil {
+			metrics.NotifyFailed(t.Source)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -225,23 +846,25 @@ func copyStagingToDestination(stagingPath, destPath string) error {
 	return nil
 }
 
-func (r *runner) createContext() (*TemplateContext, error) {
-	log.Debug("Fetching Metadata")
-
-	metaServices, err := r.Client.GetServices()
-	if err != nil {
+func createContext(snap *snapshot) (*TemplateContext, error) {
+	var metaServices []metadata.Service
+	if err := json.Unmarshal(snap.Services, &metaServices); err != nil {
 		return nil, err
 	}
-	metaContainers, err := r.Client.GetContainers()
-	if err != nil {
+	var metaContainers []metadata.Container
+	if err := json.Unmarshal(snap.Containers, &metaContainers); err != nil {
 		return nil, err
 	}
-	metaHosts, err := r.Client.GetHosts()
-	if err != nil {
+	var metaHosts []metadata.Host
+	if err := json.Unmarshal(snap.Hosts, &metaHosts); err != nil {
 		return nil, err
 	}
-	metaSelf, err := r.Client.GetSelfContainer()
-	if err != nil {
+	var metaStacks []metadata.Stack
+	if err := json.Unmarshal(snap.Stacks, &metaStacks); err != nil {
+		return nil, err
+	}
+	var metaSelf metadata.Container
+	if err := json.Unmarshal(snap.Self.Container, &metaSelf); err != nil {
 		return nil, err
 	}
 
@@ -260,13 +883,19 @@ func (r *runner) createContext() (*TemplateContext, error) {
 	containers := make([]Container, 0)
 	for _, c := range metaContainers {
 		container := Container{
-			Name:    c.Name,
-			Address: c.PrimaryIp,
-			Stack:   c.StackName,
-			Service: c.ServiceName,
-			Health:  c.HealthState,
-			State:   c.State,
-			Labels:  LabelMap(c.Labels),
+			Name:        c.Name,
+			UUID:        c.UUID,
+			CreateIndex: c.CreateIndex,
+			ExternalId:  c.ExternalId,
+			Address:     c.PrimaryIp,
+			Ips:         c.Ips,
+			Ports:       parseServicePorts(c.Ports),
+			Stack:       c.StackName,
+			Service:     c.ServiceName,
+			Health:      c.HealthState,
+			State:       c.State,
+			Labels:      LabelMap(c.Labels),
+			HostUUID:    c.HostUUID,
 		}
 		for _, h := range hosts {
 			if h.UUID == c.HostUUID {
@@ -280,11 +909,27 @@ func (r *runner) createContext() (*TemplateContext, error) {
 	services := make([]Service, 0)
 	for _, s := range metaServices {
 		service := Service{
-			Name:     s.Name,
-			Stack:    s.StackName,
-			Kind:     s.Kind,
-			Vip:      s.Vip,
-			Fqdn:     s.Fqdn,
+			Name:        s.Name,
+			Stack:       s.StackName,
+			Kind:        s.Kind,
+			UUID:        s.UUID,
+			CreateIndex: s.CreateIndex,
+			Hostname:    s.Hostname,
+			Vip:         s.Vip,
+			Fqdn:        s.Fqdn,
+			Scale:       s.Scale,
+			Token:       s.Token,
+			ExternalIps: s.ExternalIps,
+			Sidekicks:   s.Sidekicks,
+			Links:       s.Links,
+			HealthCheck: HealthCheck{
+				Port:               s.HealthCheck.Port,
+				RequestLine:        s.HealthCheck.RequestLine,
+				Interval:           s.HealthCheck.Interval,
+				ResponseTimeout:    s.HealthCheck.ResponseTimeout,
+				HealthyThreshold:   s.HealthCheck.HealthyThreshold,
+				UnhealthyThreshold: s.HealthCheck.UnhealthyThreshold,
+			},
 			Labels:   LabelMap(s.Labels),
 			Metadata: MetadataMap(s.Metadata),
 		}
@@ -298,31 +943,73 @@ func (r *runner) createContext() (*TemplateContext, error) {
 		service.Ports = parseServicePorts(s.Ports)
 		services = append(services, service)
 	}
+	resolveLinks(services)
+
+	stacks := make([]Stack, 0)
+	for _, s := range metaStacks {
+		stack := Stack{
+			Name:            s.Name,
+			EnvironmentName: s.EnvironmentName,
+			EnvironmentUUID: s.EnvironmentUUID,
+			Services:        filterServicesByStack(services, s.Name),
+		}
+		stacks = append(stacks, stack)
+	}
 
 	self := Self{
 		Stack:    metaSelf.StackName,
 		Service:  metaSelf.ServiceName,
 		HostUUID: metaSelf.HostUUID,
+		Container: Container{
+			Name:       metaSelf.Name,
+			UUID:       metaSelf.UUID,
+			ExternalId: metaSelf.ExternalId,
+			Labels:     LabelMap(metaSelf.Labels),
+		},
+	}
+	for _, c := range containers {
+		if c.UUID == metaSelf.UUID {
+			self.Container = c
+			break
+		}
+	}
+	for _, s := range stacks {
+		if s.Name == self.Stack {
+			self.EnvironmentName = s.EnvironmentName
+			self.EnvironmentUUID = s.EnvironmentUUID
+			break
+		}
 	}
 
 	ctx := TemplateContext{
+		Version:    snap.label(),
 		Services:   services,
 		Containers: containers,
 		Hosts:      hosts,
+		Stacks:     stacks,
 		Self:       self,
 	}
 
 	return &ctx, nil
 }
 
-// converts Metadata.Service.Ports string slice to a ServicePort slice
+// converts Metadata.Service.Ports and Metadata.Container.Ports string slices
+// to a ServicePort slice. Service ports have the format 'public:internal/proto',
+// container ports are prefixed with the bind address 'address:public:internal/proto'.
 func parseServicePorts(ports []string) []ServicePort {
 	var ret []ServicePort
 	for _, port := range ports {
-		if parts := strings.Split(port, ":"); len(parts) == 2 {
+		parts := strings.Split(port, ":")
+		var bindAddress string
+		if len(parts) == 3 {
+			bindAddress = parts[0]
+			parts = parts[1:]
+		}
+		if len(parts) == 2 {
 			public := parts[0]
 			if parts_ := strings.Split(parts[1], "/"); len(parts_) == 2 {
 				ret = append(ret, ServicePort{
+					BindAddress:  bindAddress,
 					PublicPort:   public,
 					InternalPort: parts_[0],
 					Protocol:     parts_[1],
@@ -330,47 +1017,47 @@ func parseServicePorts(ports []string) []ServicePort {
 				continue
 			}
 		}
-		log.Warnf("Unexpected format of service port: %s", port)
+		log.Warnf("Unexpected format of port: %s", port)
 	}
 
 	return ret
 }
 
-func check(command, filePath string) error {
+func check(logger *log.Entry, command, filePath string) error {
 	command = strings.Replace(command, "{{staging}}", filePath, -1)
-	log.Debugf("Running check command '%s'", command)
+	logger.Debugf("Running check command '%s'", command)
 	cmd := exec.Command("/bin/sh", "-c", command)
-	out, err := cmd.CombinedOutput()
+	out, err := commandOutput(cmd)
 	if err != nil {
-		logCmdOutput(command, out)
+		logCmdOutput(logger, command, out)
 		return err
 	}
 
-	log.Debugf("Check cmd output: %q", string(out))
+	logger.Debugf("Check cmd output: %q", string(out))
 	return nil
 }
 
-func notify(command string, verbose bool) error {
-	log.Infof("Executing notify command '%s'", command)
+func notify(logger *log.Entry, command string, verbose bool) error {
+	logger.Infof("Executing notify command '%s'", command)
 	cmd := exec.Command("/bin/sh", "-c", command)
-	out, err := cmd.CombinedOutput()
+	out, err := commandOutput(cmd)
 	if err != nil {
-		logCmdOutput(command, out)
+		logCmdOutput(logger, command, out)
 		return err
 	}
 
 	if verbose {
-		logCmdOutput(command, out)
+		logCmdOutput(logger, command, out)
 	}
 
-	log.Debugf("Notify cmd output: %q", string(out))
+	logger.Debugf("Notify cmd output: %q", string(out))
 	return nil
 }
 
-func logCmdOutput(command string, output []byte) {
+func logCmdOutput(logger *log.Entry, command string, output []byte) {
 	for _, line := range strings.Split(string(output), "\n") {
 		if line != "" {
-			log.Infof("[%s]: %q", command, line)
+			logger.Infof("[%s]: %q", command, line)
 		}
 	}
 }
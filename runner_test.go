@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetadata is a Metadata API that serves the version as a JSON string
+// and holds watch requests open until the version changes, maxWait
+// passes or the request is aborted.
+type fakeMetadata struct {
+	mu       sync.Mutex
+	version  string
+	changed  chan struct{}
+	values   []string // value parameters of watch requests
+	aborted  chan struct{}
+	noWatch  int  // status returned for watch requests if set
+	noBlock  bool // ignore the wait parameter
+	requests int
+}
+
+func newFakeMetadata(version string) *fakeMetadata {
+	return &fakeMetadata{
+		version: version,
+		changed: make(chan struct{}),
+		aborted: make(chan struct{}, 1),
+	}
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/latest/version" {
+		http.NotFound(w, req)
+		return
+	}
+
+	query := req.URL.Query()
+	f.mu.Lock()
+	version, changed := f.version, f.changed
+	if query.Get("wait") == "true" {
+		f.requests++
+		f.values = append(f.values, query.Get("value"))
+	}
+	f.mu.Unlock()
+
+	if query.Get("wait") == "true" && f.noWatch != 0 {
+		w.WriteHeader(f.noWatch)
+		return
+	}
+	if query.Get("wait") == "true" && !f.noBlock && query.Get("value") == version {
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			f.aborted <- struct{}{}
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Write([]byte(`"` + f.version + `"`))
+}
+
+func (f *fakeMetadata) setVersion(version string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version = version
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeMetadata) watchRequests() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests, append([]string(nil), f.values...)
+}
+
+func newWatchRunner(t *testing.T, url string) *runner {
+	conf := &Config{
+		MetadataURL:            url,
+		MetadataVersion:        "latest",
+		MetadataTimeout:        duration(time.Second),
+		MetadataConnectTimeout: duration(time.Second),
+		Watch:                  true,
+		WatchTimeout:           5,
+		Interval:               60,
+	}
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &runner{Config: conf, Client: client, Version: "1"}
+}
+
+func isDone(done <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestWaitReturnsOnVersionChange(t *testing.T) {
+	fake := newFakeMetadata("1")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	r := newWatchRunner(t, server.URL)
+	done := r.wait(nil, make(chan struct{}))
+	if isDone(done, 200*time.Millisecond) {
+		t.Fatal("wait returned before the version changed")
+	}
+
+	fake.setVersion("2")
+	if !isDone(done, time.Second) {
+		t.Fatal("wait did not return after the version changed")
+	}
+
+	if _, values := fake.watchRequests(); len(values) != 1 || values[0] != "1" {
+		t.Errorf("watch requests had values %q, want [\"1\"]", values)
+	}
+}
+
+func TestWaitCancelAbortsWatch(t *testing.T) {
+	fake := newFakeMetadata("1")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	r := newWatchRunner(t, server.URL)
+	cancel := make(chan struct{})
+	done := r.wait(nil, cancel)
+	if isDone(done, 100*time.Millisecond) {
+		t.Fatal("wait returned before it was cancelled")
+	}
+
+	close(cancel)
+	if !isDone(done, time.Second) {
+		t.Fatal("wait did not return after it was cancelled")
+	}
+	select {
+	case <-fake.aborted:
+	case <-time.After(time.Second):
+		t.Fatal("watch request was not aborted")
+	}
+	if r.watchFallback.Load() {
+		t.Error("cancelling the watch fell back to polling")
+	}
+}
+
+func TestWaitFallsBackToPolling(t *testing.T) {
+	tests := []struct {
+		name string
+		fake *fakeMetadata
+	}{
+		{"rejected", &fakeMetadata{version: "1", noWatch: http.StatusBadRequest}},
+		{"not blocking", &fakeMetadata{version: "1", noBlock: true}},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(test.fake)
+		r := newWatchRunner(t, server.URL)
+
+		for i := 0; i < 2; i++ {
+			tick := make(chan time.Time, 1)
+			done := r.wait(tick, make(chan struct{}))
+			if isDone(done, 200*time.Millisecond) {
+				t.Fatalf("%s: wait %d returned before the tick", test.name, i)
+			}
+			tick <- time.Now()
+			if !isDone(done, time.Second) {
+				t.Fatalf("%s: wait %d did not return after the tick", test.name, i)
+			}
+		}
+
+		if n, _ := test.fake.watchRequests(); n != 1 {
+			t.Errorf("%s: sent %d watch requests, want 1", test.name, n)
+		}
+		server.Close()
+	}
+}
+
+func TestPollUnquotesVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/latest/version":
+			w.Write([]byte(`"7"`))
+		case "/latest/":
+			w.Write([]byte(`{"version": "7", "services": [], "containers": [], "hosts": [],
+				"stacks": [], "self": {"container": {}}}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, dest := filepath.Join(dir, "version.tmpl"), filepath.Join(dir, "version")
+	ioutil.WriteFile(source, []byte("{{.Version}}"), 0644)
+
+	conf := &Config{
+		MetadataURL:     server.URL,
+		MetadataVersion: "latest",
+		Concurrency:     1,
+		Templates:       []Template{{Source: source, Dest: dest}},
+	}
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &runner{
+		Config:    conf,
+		Client:    client,
+		Version:   "init",
+		templates: newTemplateStates(conf),
+		fetcher:   &snapshotFetcher{client: client},
+		status:    &status{},
+	}
+
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != "7" || r.ctx.Version != "7" {
+		t.Errorf("got version %s and context version %s, want 7", r.Version, r.ctx.Version)
+	}
+	if buf, _ := ioutil.ReadFile(dest); string(buf) != "7" {
+		t.Errorf("rendered .Version as %s, want 7", buf)
+	}
+	if version := r.status.Report().Version; version != "7" {
+		t.Errorf("got status version %s, want 7", version)
+	}
+}
+
+func TestRetryFailedNotification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, dest := filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(source, []byte("{{.Version}}"), 0644)
+
+	// the notify command fails on its first run
+	marker, calls := filepath.Join(dir, "failed"), filepath.Join(dir, "calls")
+	conf := &Config{
+		Concurrency:       1,
+		RetryInitialDelay: duration(time.Millisecond),
+		RetryMaxDelay:     duration(time.Millisecond),
+		Templates: []Template{{
+			Source:    source,
+			Dest:      dest,
+			NotifyCmd: "echo >> " + calls + "; test -e " + marker + " || { touch " + marker + "; exit 1; }",
+		}},
+	}
+	ctx := &TemplateContext{Version: "1"}
+	r := &runner{Config: conf, Version: "1", ctx: ctx, activeCtx: ctx,
+		templates: newTemplateStates(conf), status: &status{}}
+
+	if err := r.processTemplates(); err == nil {
+		t.Fatal("failed notification was not reported")
+	}
+	if buf, _ := ioutil.ReadFile(dest); string(buf) != "1" {
+		t.Fatalf("destination contains %q, want 1", buf)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if !r.templatesDue() {
+		t.Fatal("template with a failed notification is not due")
+	}
+	if err := r.processTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadFile(calls); len(buf) != 2 {
+		t.Errorf("notify command ran %d times, want 2", len(buf))
+	}
+	if status := r.templates[0].Status(); status.Failures != 0 || status.LastVersion != "1" {
+		t.Errorf("got status %+v, want version 1 applied without failures", status)
+	}
+
+	// the notification is not sent again once it succeeded
+	r.templates[0].Invalidate()
+	if err := r.processTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadFile(calls); len(buf) != 2 {
+		t.Errorf("notify command ran %d times, want 2", len(buf))
+	}
+}
+
+func TestProcessTemplatesInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	order := filepath.Join(dir, "order")
+
+	// the first template takes longest to notify
+	conf := &Config{Concurrency: 1}
+	for i, name := range []string{"a", "b", "c"} {
+		source := filepath.Join(dir, name+".tmpl")
+		ioutil.WriteFile(source, []byte(name), 0644)
+		conf.Templates = append(conf.Templates, Template{
+			Source:    source,
+			Dest:      filepath.Join(dir, name+".conf"),
+			NotifyCmd: fmt.Sprintf("sleep 0.%d; echo %s >> %s", 3-i, name, order),
+		})
+	}
+	ctx := &TemplateContext{Version: "1"}
+	r := &runner{Config: conf, Version: "1", ctx: ctx, activeCtx: ctx,
+		templates: newTemplateStates(conf), status: &status{}}
+
+	if err := r.processTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadFile(order); string(buf) != "a\nb\nc\n" {
+		t.Errorf("templates were notified in order %q, want configuration order", buf)
+	}
+}
+
+func TestWaitDuringReload(t *testing.T) {
+	fake := newFakeMetadata("1")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	r := newWatchRunner(t, server.URL)
+	done := r.wait(nil, make(chan struct{}))
+
+	// a reload replaces the configuration while waiting
+	conf := *r.Config
+	conf.Interval = 30
+	r.Config = &conf
+
+	fake.setVersion("2")
+	if !isDone(done, time.Second) {
+		t.Fatal("wait did not return after the version changed")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// serveHTTP serves the health, readiness and metrics endpoints on the
+// given address.
+func serveHTTP(addr string, st *status) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if reasons := notReady(st.Report()); len(reasons) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(reasons, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteTo(w, st.Report())
+	})
+
+	log.Infof("Serving health checks and metrics on %s", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("HTTP server failed: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// notReady returns the reasons why the runner is not ready. It is ready
+// once every template has been processed successfully and the Metadata
+// API is reachable.
+func notReady(report runnerStatus) []string {
+	var reasons []string
+	if report.LastSuccess.IsZero() {
+		reasons = append(reasons, "Metadata has not been retrieved yet")
+	} else if report.ConsecutiveFailures > 0 {
+		reasons = append(reasons, fmt.Sprintf("Metadata API is unreachable: %s", report.LastError))
+	}
+	for _, t := range report.Templates {
+		if t.LastSuccess.IsZero() {
+			reasons = append(reasons, fmt.Sprintf("Template %s has not been processed successfully yet", t.Source))
+		}
+	}
+	return reasons
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotReady(t *testing.T) {
+	now := time.Now()
+	applied := templateStatus{Source: "a.tmpl", LastSuccess: now}
+	pending := templateStatus{Source: "b.tmpl"}
+
+	tests := []struct {
+		name    string
+		report  runnerStatus
+		reasons []string
+	}{
+		{
+			name:    "never fetched",
+			report:  runnerStatus{Templates: []templateStatus{pending}},
+			reasons: []string{"Metadata has not been retrieved yet", "Template b.tmpl has not been processed successfully yet"},
+		},
+		{
+			name:    "fetched but failing",
+			report:  runnerStatus{LastSuccess: now, ConsecutiveFailures: 2, LastError: "timeout", Templates: []templateStatus{applied}},
+			reasons: []string{"Metadata API is unreachable: timeout"},
+		},
+		{
+			name:    "template never succeeded",
+			report:  runnerStatus{LastSuccess: now, Templates: []templateStatus{applied, pending}},
+			reasons: []string{"Template b.tmpl has not been processed successfully yet"},
+		},
+		{
+			name:   "ready",
+			report: runnerStatus{LastSuccess: now, Templates: []templateStatus{applied}},
+		},
+	}
+
+	for _, test := range tests {
+		if reasons := notReady(test.report); strings.Join(reasons, "\n") != strings.Join(test.reasons, "\n") {
+			t.Errorf("%s: got reasons %q, want %q", test.name, reasons, test.reasons)
+		}
+	}
+}
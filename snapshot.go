@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// maxSnapshotAttempts limits how often the Metadata is fetched again
+// when the version changes while it is being fetched.
+const maxSnapshotAttempts = 3
+
+// snapshot holds the raw Metadata documents a TemplateContext is created
+// from. It is encoded in the format of the Metadata tree, so a snapshot
+// written to disk can be read back as a Metadata file.
+type snapshot struct {
+	Version    string          `json:"version"`
+	Label      string          `json:"label,omitempty"` // see label()
+	Services   json.RawMessage `json:"services"`
+	Containers json.RawMessage `json:"containers"`
+	Hosts      json.RawMessage `json:"hosts"`
+	Stacks     json.RawMessage `json:"stacks"`
+	Self       snapshotSelf    `json:"self"`
+}
+
+type snapshotSelf struct {
+	Container json.RawMessage `json:"container"`
+}
+
+// label returns the version shown to templates. It differs from the
+// version used to detect changes for Metadata files that contain a
+// version, which is only used as label.
+func (s *snapshot) label() string {
+	if s.Label != "" {
+		return s.Label
+	}
+	return s.Version
+}
+
+// complete returns true if the snapshot contains all documents needed to
+// create a TemplateContext.
+func (s *snapshot) complete() bool {
+	return s.Services != nil && s.Containers != nil && s.Hosts != nil &&
+		s.Stacks != nil && s.Self.Container != nil
+}
+
+// snapshotFetcher retrieves Metadata snapshots. It fetches the whole
+// Metadata tree with a single request and falls back to requesting each
+// collection separately if the Metadata API does not serve the tree.
+// Other failures, e.g. timeouts or server errors, are returned, so the
+// tree is requested again on the next attempt.
+type snapshotFetcher struct {
+	client        metadata.Client
+	perCollection bool
+}
+
+// Fetch retrieves the Metadata documents for the given version. The tree
+// is a single document and therefore consistent, so its version is used
+// even if the version changed since it was polled. Collections fetched
+// separately are fetched again if the version changed in the meantime.
+func (f *snapshotFetcher) Fetch(version string) (*snapshot, error) {
+	for attempt := 1; ; attempt++ {
+		snap, err := f.fetch()
+		if err != nil {
+			return nil, err
+		}
+
+		if snap.Version != "" {
+			if snap.Version != version {
+				log.Debugf("Metadata version changed from %s to %s while fetching", version, snap.Version)
+			}
+			return snap, nil
+		}
+
+		current, err := f.client.GetVersion()
+		if err != nil {
+			return nil, err
+		}
+		if current == version {
+			snap.Version = version
+			return snap, nil
+		}
+
+		if attempt == maxSnapshotAttempts {
+			return nil, fmt.Errorf("Metadata version kept changing while fetching (%d attempts)", attempt)
+		}
+
+		log.Debugf("Metadata version changed from %s to %s while fetching. Retrying.", version, current)
+		version = current
+	}
+}
+
+func (f *snapshotFetcher) fetch() (*snapshot, error) {
+	if f.perCollection {
+		return fetchCollections(f.client)
+	}
+
+	snap, err := fetchTree(f.client)
+	if err == nil {
+		return snap, nil
+	}
+	if !treeUnavailable(err) {
+		return nil, err
+	}
+
+	// Only stop requesting the tree once the collections could be
+	// fetched, the error may as well be caused by an unavailable API.
+	snap, collErr := fetchCollections(f.client)
+	if collErr != nil {
+		return nil, collErr
+	}
+
+	log.Infof("Fetching Metadata collections separately, the Metadata tree is not available: %v", err)
+	f.perCollection = true
+	return snap, nil
+}
+
+// errIncompleteTree is returned by fetchTree if the document served for
+// the version root is not the whole Metadata tree.
+var errIncompleteTree = errors.New("Metadata tree is incomplete")
+
+// treeUnavailable returns true if the error returned by fetchTree means
+// that the Metadata API does not serve the tree.
+func treeUnavailable(err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.StatusCode >= 400 && e.StatusCode < 500
+	}
+	return err == errIncompleteTree
+}
+
+// fetchTree retrieves all Metadata documents with a single request for
+// the version root.
+func fetchTree(client metadata.Client) (*snapshot, error) {
+	resp, err := client.SendRequest("/")
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &snapshot{}
+	if err := json.Unmarshal(resp, snap); err != nil || !snap.complete() {
+		return nil, errIncompleteTree
+	}
+
+	return snap, nil
+}
+
+// fetchCollections retrieves the Metadata documents with one request per
+// collection. The version of the returned snapshot is not set.
+func fetchCollections(client metadata.Client) (*snapshot, error) {
+	snap := &snapshot{}
+
+	var err error
+	if snap.Services, err = client.SendRequest("/services"); err != nil {
+		return nil, err
+	}
+	if snap.Containers, err = client.SendRequest("/containers"); err != nil {
+		return nil, err
+	}
+	if snap.Hosts, err = client.SendRequest("/hosts"); err != nil {
+		return nil, err
+	}
+	if snap.Stacks, err = client.SendRequest("/stacks"); err != nil {
+		return nil, err
+	}
+	if snap.Self.Container, err = client.SendRequest("/self/container"); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// unquoteVersion strips the JSON quotes the Metadata API may return the
+// version with.
+func unquoteVersion(version string) string {
+	return strings.Trim(version, `" `)
+}
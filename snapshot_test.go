@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeSender serves a Metadata API whose version changes with every
+// request for it. Without treeVersions the tree is not available.
+type fakeSender struct {
+	versions     []string // returned by successive version requests
+	treeVersions []string // contained in successive tree requests
+	treeFailures int      // tree requests failing with 503 first
+	requests     map[string]int
+}
+
+func (f *fakeSender) SendRequest(path string) ([]byte, error) {
+	if f.requests == nil {
+		f.requests = make(map[string]int)
+	}
+	n := f.requests[path]
+	f.requests[path]++
+
+	next := func(values []string) string {
+		if n < len(values) {
+			return values[n]
+		}
+		return values[len(values)-1]
+	}
+
+	switch path {
+	case "/version":
+		return []byte(next(f.versions)), nil
+	case "/":
+		if f.treeVersions == nil {
+			return nil, &statusError{404, path}
+		}
+		if n < f.treeFailures {
+			return nil, &statusError{503, path}
+		}
+		return []byte(fmt.Sprintf(`{"version": %q, "services": [], "containers": [],
+			"hosts": [], "stacks": [], "self": {"container": {}}}`, next(f.treeVersions))), nil
+	case "/self/container":
+		return []byte("{}"), nil
+	default:
+		return []byte("[]"), nil
+	}
+}
+
+func TestFetchTree(t *testing.T) {
+	tests := []struct {
+		name        string
+		treeVersion string
+		want        string
+	}{
+		{"same version", "1", "1"},
+		{"changed version", "2", "2"},
+	}
+
+	for _, test := range tests {
+		sender := &fakeSender{versions: []string{`"3"`}, treeVersions: []string{test.treeVersion}}
+		fetcher := &snapshotFetcher{client: &baseClient{sender}}
+
+		snap, err := fetcher.Fetch("1")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if snap.Version != test.want {
+			t.Errorf("%s: got version %s, want %s", test.name, snap.Version, test.want)
+		}
+		if sender.requests["/"] != 1 || sender.requests["/version"] != 0 {
+			t.Errorf("%s: sent requests %v, want a single tree request", test.name, sender.requests)
+		}
+	}
+}
+
+func TestFetchCollections(t *testing.T) {
+	sender := &fakeSender{versions: []string{"2", "2"}}
+	fetcher := &snapshotFetcher{client: &baseClient{sender}}
+
+	snap, err := fetcher.Fetch("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Version != "2" {
+		t.Errorf("got version %s, want 2", snap.Version)
+	}
+	if n := sender.requests["/services"]; n != 2 {
+		t.Errorf("fetched collections %d times, want 2", n)
+	}
+
+	sender = &fakeSender{versions: []string{"2", "3", "4", "5"}}
+	fetcher = &snapshotFetcher{client: &baseClient{sender}, perCollection: true}
+	if _, err := fetcher.Fetch("1"); err == nil {
+		t.Error("fetching collections of a changing version succeeded")
+	}
+	if n := sender.requests["/services"]; n != maxSnapshotAttempts {
+		t.Errorf("fetched collections %d times, want %d", n, maxSnapshotAttempts)
+	}
+}
+
+func TestFetchTreeAfterFailure(t *testing.T) {
+	sender := &fakeSender{versions: []string{"1"}, treeVersions: []string{"1"}, treeFailures: 1}
+	fetcher := &snapshotFetcher{client: &baseClient{sender}}
+
+	if _, err := fetcher.Fetch("1"); err == nil {
+		t.Fatal("fetching an unavailable tree succeeded")
+	}
+	if fetcher.perCollection || sender.requests["/services"] != 0 {
+		t.Errorf("fell back to fetching collections after a server error")
+	}
+
+	if _, err := fetcher.Fetch("1"); err != nil {
+		t.Fatal(err)
+	}
+	if sender.requests["/"] != 2 || sender.requests["/services"] != 0 {
+		t.Errorf("sent requests %v, want two tree requests", sender.requests)
+	}
+}
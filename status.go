@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// failureLogInterval limits how often repeated Metadata failures are
+// logged at error level.
+const failureLogInterval = time.Minute
+
+// metadataError is returned by poll when the Metadata could not be
+// retrieved.
+type metadataError struct {
+	err error
+}
+
+func (e metadataError) Error() string {
+	return e.err.Error()
+}
+
+// runnerStatus is a report of the state of the runner.
+type runnerStatus struct {
+	Version             string
+	Degraded            bool
+	ConsecutiveFailures int
+	LastError           string
+	LastSuccess         time.Time
+	Templates           []templateStatus
+}
+
+// status tracks the state of the runner. It is safe for concurrent use.
+type status struct {
+	mu            sync.Mutex
+	degradedAfter int
+	report        runnerStatus
+	lastLogged    time.Time
+}
+
+// MetadataFailure records a failed attempt to query the Metadata API.
+// Repeated failures are logged at most once per failureLogInterval.
+func (s *status) MetadataFailure(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.report.ConsecutiveFailures++
+	s.report.LastError = err.Error()
+
+	if s.report.ConsecutiveFailures == 1 || time.Since(s.lastLogged) >= failureLogInterval {
+		log.Errorf("%v (%d consecutive failures)", err, s.report.ConsecutiveFailures)
+		s.lastLogged = time.Now()
+	} else {
+		log.Debug(err)
+	}
+
+	if !s.report.Degraded && s.degradedAfter > 0 && s.report.ConsecutiveFailures >= s.degradedAfter {
+		log.Warnf("Entering degraded state after %d consecutive Metadata failures", s.report.ConsecutiveFailures)
+		s.report.Degraded = true
+	}
+}
+
+// MetadataSuccess records a successful query of the given Metadata version.
+func (s *status) MetadataSuccess(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.report.ConsecutiveFailures > 0 {
+		log.Infof("Metadata API recovered after %d consecutive failures", s.report.ConsecutiveFailures)
+	}
+	if s.report.Degraded {
+		log.Info("Leaving degraded state")
+	}
+
+	s.report.Version = version
+	s.report.Degraded = false
+	s.report.ConsecutiveFailures = 0
+	s.report.LastSuccess = time.Now()
+}
+
+// SetTemplates replaces the status of the templates.
+func (s *status) SetTemplates(templates []templateStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.report.Templates = templates
+}
+
+// Report returns a copy of the current status.
+func (s *status) Report() runnerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.report
+}
+
+// logStatus writes the current status to the log.
+func (s *status) logStatus() {
+	report := s.Report()
+	log.Infof("Status: metadata version=%s, degraded=%t, consecutive failures=%d, last success=%s, last error=%q",
+		report.Version, report.Degraded, report.ConsecutiveFailures, formatTime(report.LastSuccess), report.LastError)
+	for _, t := range report.Templates {
+		log.Infof("Status: template %s, destination=%s, applied version=%s, last success=%s, failures=%d, last error=%q",
+			t.Source, t.Dest, t.LastVersion, formatTime(t.LastSuccess), t.Failures, t.LastError)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
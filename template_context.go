@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 type NotFoundError struct {
@@ -14,13 +17,47 @@ func (e NotFoundError) Error() string {
 	return e.msg
 }
 
+// activeStates are the container states considered active. Containers
+// in any other state (e.g. starting, stopped or error) are excluded from
+// the TemplateContext unless inactive containers are included.
+var activeStates = []string{"running", "updating-running"}
+
 type TemplateContext struct {
+	Version    string // Metadata version the context was created from
 	Services   []Service
 	Containers []Container
 	Hosts      []Host
+	Stacks     []Stack
 	Self       Self
 }
 
+// activeOnly returns a copy of the context without containers that are
+// not in one of the active states.
+func (c *TemplateContext) activeOnly() *TemplateContext {
+	ctx := *c
+	ctx.Containers = filterActiveContainers(c.Containers)
+
+	ctx.Services = make([]Service, 0, len(c.Services))
+	for _, s := range c.Services {
+		s.Containers = filterActiveContainers(s.Containers)
+		linked := make([]Service, 0, len(s.LinkedServices))
+		for _, l := range s.LinkedServices {
+			l.Containers = filterActiveContainers(l.Containers)
+			linked = append(linked, l)
+		}
+		s.LinkedServices = linked
+		ctx.Services = append(ctx.Services, s)
+	}
+
+	ctx.Stacks = make([]Stack, 0, len(c.Stacks))
+	for _, s := range c.Stacks {
+		s.Services = filterServicesByStack(ctx.Services, s.Name)
+		ctx.Stacks = append(ctx.Stacks, s)
+	}
+
+	return &ctx
+}
+
 // GetHost returns the Host with the given UUID. If the argument is omitted
 // the local host is returned.
 func (c *TemplateContext) GetHost(v ...string) (Host, error) {
@@ -76,6 +113,18 @@ func (c *TemplateContext) GetService(v ...string) (Service, error) {
 	return Service{}, NotFoundError{"(service) could not find service by identifier: " + identifier}
 }
 
+// GetLinks returns the services linked from the service matching the given
+// identifier in the form 'service-name[.stack-name]'. If the argument is
+// omitted the links of the service of the current container are returned.
+func (c *TemplateContext) GetLinks(v ...string) ([]Service, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.LinkedServices, nil
+}
+
 func (c *TemplateContext) GetHosts(selectors ...string) ([]Host, error) {
 	if len(selectors) == 0 {
 		return c.Hosts, nil
@@ -136,6 +185,142 @@ func (c *TemplateContext) GetServices(selectors ...string) ([]Service, error) {
 	return services, nil
 }
 
+// GetStack returns the stack with the given name. If the argument is
+// omitted the stack of the current container is returned.
+func (c *TemplateContext) GetStack(v ...string) (Stack, error) {
+	name := ""
+	if len(v) > 0 {
+		name = v[0]
+	}
+	if name == "" {
+		name = c.Self.Stack
+	}
+
+	for _, s := range c.Stacks {
+		if strings.EqualFold(s.Name, name) {
+			return s, nil
+		}
+	}
+
+	return Stack{}, NotFoundError{"(stack) could not find stack by name: " + name}
+}
+
+// GetStacks returns the stacks containing services that match the given
+// stack and label selectors. The Services of the returned stacks are
+// limited to the matching services.
+func (c *TemplateContext) GetStacks(selectors ...string) ([]Stack, error) {
+	if len(selectors) == 0 {
+		return c.Stacks, nil
+	}
+
+	services, err := c.GetServices(selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Stack, 0)
+	for _, s := range c.Stacks {
+		if stackServices := filterServicesByStack(services, s.Name); len(stackServices) > 0 {
+			s.Services = stackServices
+			result = append(result, s)
+		}
+	}
+
+	return result, nil
+}
+
+// resolveLinks populates the LinkedServices of the given services and
+// sets the containers of alias services to the containers of the services
+// they link to.
+func resolveLinks(services []Service) {
+	aliasContainers := make(map[int][]Container)
+	for i, s := range services {
+		if s.Kind == "dnsService" {
+			containers, cycles := followLinks(services, s, map[string]bool{})
+			for _, key := range cycles {
+				log.Debugf("Ignoring cyclic link to alias service %s", key)
+			}
+			aliasContainers[i] = containers
+		}
+	}
+
+	for i := range services {
+		if containers, ok := aliasContainers[i]; ok {
+			services[i].Containers = containers
+		}
+	}
+
+	for i := range services {
+		services[i].LinkedServices = findLinkedServices(services, services[i])
+	}
+}
+
+// followLinks returns the containers of the services the alias links to.
+// Links to other aliases are followed recursively, cyclic links are ignored
+// and returned as cycles. visited holds the aliases on the path to the alias,
+// so aliases reached through several links are not mistaken for cycles.
+func followLinks(services []Service, alias Service, visited map[string]bool) ([]Container, []string) {
+	key := alias.Stack + "/" + alias.Name
+	if visited[key] {
+		return nil, []string{key}
+	}
+	visited[key] = true
+	defer delete(visited, key)
+
+	result := make([]Container, 0)
+	seen := make(map[string]bool)
+	var cycles []string
+	for _, target := range findLinkedServices(services, alias) {
+		containers := target.Containers
+		if target.Kind == "dnsService" {
+			var targetCycles []string
+			containers, targetCycles = followLinks(services, target, visited)
+			cycles = append(cycles, targetCycles...)
+		}
+		for _, c := range containers {
+			if id := c.Stack + "/" + c.Name; !seen[id] {
+				seen[id] = true
+				result = append(result, c)
+			}
+		}
+	}
+
+	return result, cycles
+}
+
+// findLinkedServices returns the services the given service links to,
+// ordered by link target. Link targets have the form 'stack-name/service-name',
+// targets without a stack name refer to the stack of the linking service.
+func findLinkedServices(services []Service, s Service) []Service {
+	targets := make([]string, 0, len(s.Links))
+	for target := range s.Links {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	result := make([]Service, 0)
+	for _, target := range targets {
+		stack, name := s.Stack, target
+		if parts := strings.SplitN(target, "/", 2); len(parts) == 2 {
+			stack, name = parts[0], parts[1]
+		}
+		found := false
+		for _, l := range services {
+			if strings.EqualFold(l.Name, name) && strings.EqualFold(l.Stack, stack) {
+				l.LinkedServices = nil
+				result = append(result, l)
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Debugf("Could not find service %s linked from %s/%s", target, s.Stack, s.Name)
+		}
+	}
+
+	return result
+}
+
 // returns true if the LabelMap needle is a subset of the LabelMap stack.
 // the needle map may contain regex in it's values.
 func inLabelMap(stack, needle LabelMap) bool {
@@ -177,6 +362,19 @@ func filterServicesByLabel(services []Service, labels LabelMap) []Service {
 	return result
 }
 
+func filterActiveContainers(containers []Container) []Container {
+	result := make([]Container, 0)
+	for _, c := range containers {
+		for _, state := range activeStates {
+			if strings.EqualFold(c.State, state) {
+				result = append(result, c)
+				break
+			}
+		}
+	}
+	return result
+}
+
 func filterServicesByStack(services []Service, stack string) []Service {
 	result := make([]Service, 0)
 	for _, s := range services {
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func containerNames(containers []Container) []string {
+	names := make([]string, 0, len(containers))
+	for _, c := range containers {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestResolveLinks(t *testing.T) {
+	backend := func(name string) Service {
+		return Service{Name: name, Stack: "prod", Kind: "service",
+			Containers: []Container{{Name: "prod_" + name + "_1", Stack: "prod"}}}
+	}
+	alias := func(name string, targets ...string) Service {
+		links := make(map[string]string)
+		for _, target := range targets {
+			links[target] = target
+		}
+		return Service{Name: name, Stack: "prod", Kind: "dnsService", Links: links}
+	}
+
+	tests := []struct {
+		name     string
+		services []Service
+		want     []string // containers of the first service
+		cycles   []string // cyclic links found from the first service
+	}{
+		{
+			name:     "diamond",
+			services: []Service{alias("top", "left", "right"), alias("left", "shared"), alias("right", "shared"), alias("shared", "web"), backend("web")},
+			want:     []string{"prod_web_1"},
+		},
+		{
+			name:     "diamond with distinct backends",
+			services: []Service{alias("top", "left", "right"), alias("left", "shared", "db"), alias("right", "shared"), alias("shared", "web"), backend("web"), backend("db")},
+			want:     []string{"prod_db_1", "prod_web_1"},
+		},
+		{
+			name:     "cycle",
+			services: []Service{alias("a", "b"), alias("b", "a", "web"), backend("web")},
+			want:     []string{"prod_web_1"},
+			cycles:   []string{"prod/a"},
+		},
+	}
+
+	for _, test := range tests {
+		_, cycles := followLinks(test.services, test.services[0], map[string]bool{})
+		if strings.Join(cycles, ",") != strings.Join(test.cycles, ",") {
+			t.Errorf("%s: got cycles %v, want %v", test.name, cycles, test.cycles)
+		}
+
+		resolveLinks(test.services)
+		if got := containerNames(test.services[0].Containers); strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: got containers %v, want %v", test.name, got, test.want)
+		}
+	}
+}
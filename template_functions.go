@@ -12,8 +12,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
-func newFuncMap(ctx *TemplateContext) template.FuncMap {
-	return template.FuncMap{
+func newFuncMap(ctx *TemplateContext, deps *dependencies) template.FuncMap {
+	funcs := template.FuncMap{
 		// Utility funcs
 		"base":      path.Base,
 		"dir":       path.Dir,
@@ -27,15 +27,18 @@ func newFuncMap(ctx *TemplateContext) template.FuncMap {
 		"replace":   strings.Replace,
 
 		// Service funcs
-		"host":              hostFunc(ctx),
-		"hosts":             hostsFunc(ctx),
-		"service":           serviceFunc(ctx),
-		"services":          servicesFunc(ctx),
 		"whereLabelExists":  whereLabelExists,
 		"whereLabelEquals":  whereLabelEquals,
 		"whereLabelMatches": whereLabelEquals,
 		"groupByLabel":      groupByLabel,
 	}
+
+	// Lookup funcs: host, hosts, service, services, links, stack, stacks
+	for name, fn := range lookupFuncs {
+		funcs[name] = deps.track(name, fn(ctx))
+	}
+
+	return funcs
 }
 
 // serviceFunc returns a single service given a string argument in the form
@@ -59,6 +62,39 @@ func servicesFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
 	}
 }
 
+// linksFunc returns the services linked from a service given a string
+// argument in the form <service-name>[.<stack-name>].
+func linksFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
+	return func(s ...string) (result interface{}, err error) {
+		result, err = ctx.GetLinks(s...)
+		if _, ok := err.(NotFoundError); ok {
+			log.Debug(err)
+			return nil, nil
+		}
+		return
+	}
+}
+
+// stackFunc returns a single stack given it's name.
+func stackFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
+	return func(s ...string) (result interface{}, err error) {
+		result, err = ctx.GetStack(s...)
+		if _, ok := err.(NotFoundError); ok {
+			log.Debug(err)
+			return nil, nil
+		}
+		return
+	}
+}
+
+// stacksFunc returns all available stacks, optionally filtered by stack
+// name or the label values of their services.
+func stacksFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
+	return func(s ...string) (interface{}, error) {
+		return ctx.GetStacks(s...)
+	}
+}
+
 // hostFunc returns a single host given it's UUID.
 func hostFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
 	return func(s ...string) (result interface{}, err error) {
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// templateState tracks the processing of a template across Metadata
+// versions. A template that failed is retried with backoff until it has
+// been applied successfully for the current version.
+type templateState struct {
+	Template Template
+
+	lastVersion    string // last version applied successfully
+	attempted      string // last version processing was attempted for
+	lastSuccess    time.Time
+	lastError      string
+	failures       int
+	nextRetry      time.Time
+	backoff        *backoff
+	quiet          *quiescence
+	deps           *dependencies // lookups of the last successful render
+	content        []byte        // content last written to the destination
+	contentVersion string        // version the content was rendered for
+	notifyPending  bool          // the content was written, but notifying failed
+}
+
+// templateStatus is a report of the state of a template.
+type templateStatus struct {
+	Source      string
+	Dest        string
+	LastVersion string
+	LastSuccess time.Time
+	LastError   string
+	Failures    int
+}
+
+func newTemplateStates(conf *Config) []*templateState {
+	policy := conf.retryPolicy()
+	policy.MaxElapsed = 0
+	states := make([]*templateState, 0, len(conf.Templates))
+	for _, t := range conf.Templates {
+		var window waitWindow
+		if !conf.OneTime {
+			window = conf.Wait
+			if t.Wait != nil {
+				window = *t.Wait
+			}
+		}
+		states = append(states, &templateState{
+			Template: t,
+			backoff:  newBackoff(policy),
+			quiet:    newQuiescence(window, systemClock{}),
+		})
+	}
+	return states
+}
+
+// Changed records that the Metadata changed to the given version. If the
+// last attempt to process the template succeeded and its Metadata lookups
+// return the same results for the new context, the template is considered
+// applied for the version. Otherwise, once a template has been applied,
+// processing is delayed by its wait window.
+func (t *templateState) Changed(version string, ctx *TemplateContext) {
+	if t.lastVersion == "" || t.lastVersion == version {
+		return
+	}
+
+	// After a failed attempt the destination may hold content that does
+	// not match the lookups of the last successful render.
+	if t.failures == 0 && t.attempted == t.lastVersion && !t.deps.Changed(ctx) {
+		log.Debugf("Metadata used by template %s is unchanged in version %s", t.Template.Source, version)
+		t.lastVersion = version
+		t.attempted = version
+		t.quiet.Reset()
+		return
+	}
+
+	t.quiet.Change()
+}
+
+// Waiting returns the time left until the wait window of a template with
+// pending changes ends.
+func (t *templateState) Waiting() (time.Duration, bool) {
+	return t.quiet.Pending()
+}
+
+// Due returns true if the template needs to be processed for the given
+// version. Templates that failed for the version are due once their
+// retry delay has passed.
+func (t *templateState) Due(version string) bool {
+	if t.lastVersion == version {
+		return false
+	}
+	if _, waiting := t.Waiting(); waiting {
+		return false
+	}
+	return t.attempted != version || !time.Now().Before(t.nextRetry)
+}
+
+// Invalidate makes the template due regardless of the Metadata version,
+// e.g. because its source has changed.
+func (t *templateState) Invalidate() {
+	t.lastVersion = ""
+	t.attempted = ""
+	t.quiet.Reset()
+}
+
+// Done records the result of processing the template for the given version.
+// If processing failed, it returns the delay before the template is retried.
+func (t *templateState) Done(version string, out *render, err error) time.Duration {
+	t.attempted = version
+	t.quiet.Reset()
+
+	// The destination may have been written before a notification failed.
+	// The notifications are then sent again by the next attempt, even if
+	// the destination is up to date by then.
+	if out.updated {
+		t.content, t.contentVersion = out.content, version
+		t.notifyPending = err != nil
+	}
+
+	if err == nil {
+		if t.failures > 0 {
+			log.Infof("Template %s succeeded after %d failed attempts", t.Template.Source, t.failures)
+		}
+		t.lastVersion = version
+		t.deps = &out.deps
+		t.content, t.contentVersion = out.content, version
+		t.lastSuccess = time.Now()
+		t.lastError = ""
+		t.failures = 0
+		t.backoff.Reset()
+		return 0
+	}
+
+	t.failures++
+	t.lastError = err.Error()
+	delay, _ := t.backoff.Next()
+	t.nextRetry = time.Now().Add(delay)
+	return delay
+}
+
+// NotifyPending returns true if the destination has been written but
+// its notifications failed.
+func (t *templateState) NotifyPending() bool {
+	return t.notifyPending
+}
+
+// Applied returns true if the template has been processed successfully
+// at least once.
+func (t *templateState) Applied() bool {
+	return !t.lastSuccess.IsZero()
+}
+
+// Status returns a report of the state of the template.
+func (t *templateState) Status() templateStatus {
+	return templateStatus{
+		Source:      t.Template.Source,
+		Dest:        t.Template.Dest,
+		LastVersion: t.lastVersion,
+		LastSuccess: t.lastSuccess,
+		LastError:   t.lastError,
+		Failures:    t.failures,
+	}
+}
+
+// templateError is the error of a template that failed to process.
+type templateError struct {
+	Template Template
+	Err      error
+}
+
+// templateErrors collects the errors of all templates that failed to
+// process in a cycle.
+type templateErrors []templateError
+
+func (e templateErrors) Error() string {
+	failures := make([]string, 0, len(e))
+	for _, te := range e {
+		failures = append(failures, fmt.Sprintf("%s (%v)", te.Template.Source, te.Err))
+	}
+	return fmt.Sprintf("%d template(s) failed: %s", len(e), strings.Join(failures, "; "))
+}
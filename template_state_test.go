@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestState() *templateState {
+	conf := &Config{
+		Templates:         []Template{{Source: "test.tmpl"}},
+		RetryInitialDelay: duration(time.Millisecond),
+		RetryMaxDelay:     duration(time.Millisecond),
+	}
+	return newTemplateStates(conf)[0]
+}
+
+// renderServices returns the result of a render that looked up the
+// services of the context.
+func renderServices(ctx *TemplateContext) *render {
+	out := &render{}
+	out.deps.track("services", lookupFuncs["services"](ctx))()
+	return out
+}
+
+func TestChangedSkipsUnchangedLookups(t *testing.T) {
+	ctx := &TemplateContext{Services: []Service{{Name: "web", Stack: "prod"}}}
+	changed := &TemplateContext{Services: []Service{{Name: "db", Stack: "prod"}}}
+
+	state := newTestState()
+	state.Changed("1", ctx)
+	state.Done("1", renderServices(ctx), nil)
+
+	for _, version := range []string{"2", "3"} {
+		state.Changed(version, ctx)
+		if state.Due(version) {
+			t.Errorf("template with unchanged lookups is due for version %s", version)
+		}
+	}
+
+	state.Changed("4", changed)
+	if !state.Due("4") {
+		t.Error("template with changed lookups is not due")
+	}
+}
+
+func TestChangedAfterFailure(t *testing.T) {
+	v4 := &TemplateContext{Services: []Service{{Name: "web", Stack: "prod"}}}
+	v5 := &TemplateContext{Services: []Service{{Name: "db", Stack: "prod"}}}
+
+	state := newTestState()
+	state.Changed("4", v4)
+	state.Done("4", renderServices(v4), nil)
+
+	// v5 is written to the destination, but its notification fails
+	state.Changed("5", v5)
+	state.Done("5", renderServices(v5), errors.New("notify failed"))
+
+	// v6 has the lookups of v4, but the destination holds v5
+	state.Changed("6", v4)
+	time.Sleep(10 * time.Millisecond)
+	if !state.Due("6") {
+		t.Fatal("template is not due after a failed attempt")
+	}
+
+	state.Done("6", renderServices(v4), nil)
+	if status := state.Status(); status.LastVersion != "6" || status.Failures != 0 {
+		t.Errorf("got status %+v, want version 6 applied without failures", status)
+	}
+}
@@ -2,27 +2,53 @@ package main
 
 // Service represents a Rancher service.
 type Service struct {
-	Name       string
-	Stack      string
-	Kind       string // service, loadBalancerService
-	Vip        string
-	Fqdn       string
-	Ports      []ServicePort
-	Labels     LabelMap
-	Metadata   MetadataMap
-	Containers []Container
+	Name           string
+	Stack          string
+	Kind           string // service, loadBalancerService, dnsService, externalService
+	UUID           string
+	CreateIndex    int
+	Hostname       string
+	Vip            string
+	Fqdn           string
+	Scale          int
+	Token          string
+	ExternalIps    []string
+	Sidekicks      []string
+	Links          map[string]string // link target (stack/service) => alias
+	Ports          []ServicePort
+	HealthCheck    HealthCheck
+	Labels         LabelMap
+	Metadata       MetadataMap
+	Containers     []Container
+	LinkedServices []Service // resolved Links, without their own LinkedServices
+}
+
+// HealthCheck represents the health check configuration of a service.
+type HealthCheck struct {
+	Port               int
+	RequestLine        string
+	Interval           int // milliseconds
+	ResponseTimeout    int // milliseconds
+	HealthyThreshold   int
+	UnhealthyThreshold int
 }
 
 // Container represents a container belonging to a Rancher Service.
 type Container struct {
-	Name    string
-	Address string
-	Stack   string
-	Service string
-	Health  string
-	State   string
-	Labels  LabelMap
-	Host    Host
+	Name        string
+	UUID        string
+	CreateIndex int
+	ExternalId  string // Docker container ID
+	Address     string
+	Ips         []string
+	Ports       []ServicePort
+	Stack       string
+	Service     string
+	Health      string
+	State       string
+	Labels      LabelMap
+	HostUUID    string
+	Host        Host
 }
 
 // Host represents a Rancher Host.
@@ -34,15 +60,27 @@ type Host struct {
 	Labels   LabelMap
 }
 
+// Stack represents a Rancher stack.
+type Stack struct {
+	Name            string
+	EnvironmentName string
+	EnvironmentUUID string
+	Services        []Service
+}
+
 // Self contains information about the container running this application.
 type Self struct {
-	Stack    string
-	Service  string
-	HostUUID string
+	Stack           string
+	Service         string
+	HostUUID        string
+	EnvironmentName string
+	EnvironmentUUID string
+	Container       Container
 }
 
-// ServicePort represents a port exposed by a service
+// ServicePort represents a port exposed by a service or container
 type ServicePort struct {
+	BindAddress  string // only set for container ports
 	PublicPort   string
 	InternalPort string
 	Protocol     string